@@ -0,0 +1,197 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const auditLogFlushInterval = time.Second
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	Time       time.Time `json:"time"`
+	ClientAddr string    `json:"client_addr"`
+	Country    string    `json:"country,omitempty"` // with -geoip-db, as in snid_client_country_connections_total
+	ServerName string    `json:"server_name,omitempty"`
+	Outcome    string    `json:"outcome"`         // "ok", or the error label (as in snid_connection_errors_total)
+	Error      string    `json:"error,omitempty"` // the error, if the connection failed
+}
+
+// AuditLog appends AuditRecords, one JSON object per line, to a file
+// which is rotated when it would exceed MaxSize bytes, keeping up to
+// MaxFiles rotated files named PATH.1 (the newest) to PATH.MaxFiles.
+// Writes are buffered, and flushed every second and by Close.
+type AuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	closed chan struct{}
+}
+
+func OpenAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	audit := &AuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles, closed: make(chan struct{})}
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+	go audit.flushPeriodically()
+	return audit, nil
+}
+
+func (audit *AuditLog) open() error {
+	file, err := os.OpenFile(audit.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	audit.file = file
+	audit.writer = bufio.NewWriter(file)
+	audit.size = info.Size()
+	return nil
+}
+
+// Record appends record to the audit log.  It does nothing if audit is nil.
+func (audit *AuditLog) Record(record *AuditRecord) {
+	if audit == nil {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding audit record: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	if audit.file == nil {
+		return
+	}
+	if audit.maxSize != 0 && audit.size != 0 && audit.size+int64(len(line)) > audit.maxSize {
+		if err := audit.rotate(); err != nil {
+			log.Printf("Error rotating audit log %s: %s", audit.path, err)
+			if audit.file == nil {
+				return
+			}
+		}
+	}
+	n, err := audit.writer.Write(line)
+	audit.size += int64(n)
+	if err != nil {
+		log.Printf("Error writing audit log %s: %s", audit.path, err)
+	}
+}
+
+// rotate closes the current file, shifts the rotated files up by one
+// (discarding the oldest), and opens a new file.  If shifting fails, the
+// current file is reopened so that records aren't lost.  audit.mu must
+// be held.
+func (audit *AuditLog) rotate() error {
+	audit.writer.Flush()
+	if err := audit.file.Close(); err != nil {
+		log.Printf("Error closing audit log %s: %s", audit.path, err)
+	}
+	audit.file = nil
+	shiftErr := audit.shift()
+	if err := audit.open(); err != nil {
+		return err
+	}
+	return shiftErr
+}
+
+func (audit *AuditLog) shift() error {
+	if audit.maxFiles == 0 {
+		return os.Remove(audit.path)
+	}
+	for i := audit.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(audit.rotatedPath(i), audit.rotatedPath(i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(audit.path, audit.rotatedPath(1))
+}
+
+func (audit *AuditLog) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", audit.path, n)
+}
+
+func (audit *AuditLog) flushPeriodically() {
+	ticker := time.NewTicker(auditLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			audit.mu.Lock()
+			if audit.file != nil {
+				if err := audit.writer.Flush(); err != nil {
+					log.Printf("Error writing audit log %s: %s", audit.path, err)
+				}
+			}
+			audit.mu.Unlock()
+		case <-audit.closed:
+			return
+		}
+	}
+}
+
+// Close flushes and closes the audit log.  Records after Close are
+// discarded.
+func (audit *AuditLog) Close() error {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	select {
+	case <-audit.closed:
+		return nil
+	default:
+		close(audit.closed)
+	}
+	if audit.file == nil {
+		return nil
+	}
+	err := audit.writer.Flush()
+	if closeErr := audit.file.Close(); err == nil {
+		err = closeErr
+	}
+	audit.file = nil
+	return err
+}
@@ -31,6 +31,10 @@ import (
 
 type BackendConn interface {
 	net.Conn
+}
+
+// CloseWriter is implemented by BackendConns which can be half-closed
+type CloseWriter interface {
 	CloseWrite() error
 }
 
@@ -39,6 +43,13 @@ type ClientConn interface {
 	RemoteAddr() net.Addr
 }
 
+// BackendPortOverrider may be implemented by a ClientConn to specify the
+// backend port, overriding the port that the BackendDialer would use
+// (unless it returns 0)
+type BackendPortOverrider interface {
+	BackendPort() int
+}
+
 type BackendDialer interface {
 	Dial(string, []string, ClientConn) (BackendConn, error)
 }
@@ -0,0 +1,110 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// CIDRSet is a set of CIDRs which can be tested for membership in
+// logarithmic time.  The CIDRs are stored as a sorted list of
+// non-overlapping address ranges, so overlapping and adjacent CIDRs are
+// merged.  Like net.IPNet, IPv4 CIDRs contain IPv4-mapped IPv6
+// addresses, but IPv6 CIDRs never contain IPv4 addresses.
+type CIDRSet struct {
+	ranges []addrRange
+}
+
+type addrRange struct {
+	first, last netip.Addr
+}
+
+func NewCIDRSet(cidrs []*net.IPNet) *CIDRSet {
+	ranges := make([]addrRange, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		ip, mask := cidr.IP, cidr.Mask
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+		}
+		if len(ip) != len(mask) {
+			continue
+		}
+		first, last := make(net.IP, len(ip)), make(net.IP, len(ip))
+		for i := range ip {
+			first[i] = ip[i] & mask[i]
+			last[i] = ip[i] | ^mask[i]
+		}
+		ranges = append(ranges, addrRange{ipToAddr(first), ipToAddr(last)})
+	}
+	slices.SortFunc(ranges, func(a, b addrRange) int { return a.first.Compare(b.first) })
+
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 {
+			prev := &merged[n-1]
+			if next := prev.last.Next(); r.first.Compare(prev.last) <= 0 || (next.IsValid() && r.first == next) {
+				if r.last.Compare(prev.last) > 0 {
+					prev.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return &CIDRSet{ranges: slices.Clip(merged)}
+}
+
+// Contains reports whether ip is within any of the set's CIDRs.  A nil
+// CIDRSet is empty.
+func (set *CIDRSet) Contains(ip net.IP) bool {
+	if set == nil || ip.To16() == nil {
+		return false
+	}
+	addr := ipToAddr(ip)
+	// Find the first range starting after addr; the range before it is
+	// the only one which can contain addr
+	i, _ := slices.BinarySearchFunc(set.ranges, addr, func(r addrRange, addr netip.Addr) int {
+		if r.first.Compare(addr) <= 0 {
+			return -1
+		}
+		return 1
+	})
+	return i > 0 && addr.Compare(set.ranges[i-1].last) <= 0
+}
+
+// ipToAddr converts ip to a netip.Addr, as a 4-byte address if it is an
+// IPv4 or IPv4-mapped IPv6 address
+func ipToAddr(ip net.IP) netip.Addr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return netip.AddrFrom4([4]byte(ip4))
+	}
+	return netip.AddrFrom16([16]byte(ip.To16()))
+}
@@ -0,0 +1,218 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"testing"
+)
+
+func mustParseCIDRs(t testing.TB, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	var ipnets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets
+}
+
+func TestCIDRSetContains(t *testing.T) {
+	tests := []struct {
+		cidrs []string
+		ip    string
+		want  bool
+	}{
+		// Merge boundaries: adjacent and overlapping CIDRs are merged,
+		// but the addresses either side of the merged range aren't
+		// contained
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "10.0.0.127", true},
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "10.0.0.128", true},
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "10.0.0.255", true},
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "10.0.1.0", false},
+		{[]string{"10.0.0.0/25", "10.0.0.128/25"}, "9.255.255.255", false},
+		{[]string{"10.0.0.0/24", "10.0.0.64/26"}, "10.0.0.255", true},
+		{[]string{"10.0.0.64/26", "10.0.0.0/24"}, "10.0.0.0", true},
+		{[]string{"10.0.0.0/26", "10.0.0.128/26"}, "10.0.0.64", false},
+		{[]string{"10.0.0.0/26", "10.0.0.128/26"}, "10.0.0.127", false},
+		{[]string{"10.0.0.0/26", "10.0.0.128/26"}, "10.0.0.128", true},
+		{[]string{"192.0.2.1/32"}, "192.0.2.1", true},
+		{[]string{"192.0.2.1/32"}, "192.0.2.2", false},
+		{[]string{"192.0.2.1/32"}, "192.0.2.0", false},
+
+		// The ends of each address family
+		{[]string{"0.0.0.0/0"}, "255.255.255.255", true},
+		{[]string{"0.0.0.0/0"}, "0.0.0.0", true},
+		{[]string{"255.255.255.255/32", "::/128"}, "255.255.255.255", true},
+		{[]string{"255.255.255.255/32", "::/128"}, "::", true},
+		{[]string{"::/0"}, "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{[]string{"2001:db8::/32", "2001:db9::/32"}, "2001:db9:ffff:ffff:ffff:ffff:ffff:ffff", true},
+		{[]string{"2001:db8::/32", "2001:db9::/32"}, "2001:dba::", false},
+
+		// IPv4 CIDRs contain IPv4-mapped IPv6 addresses, but IPv6 CIDRs
+		// never contain IPv4 addresses
+		{[]string{"192.0.2.0/24"}, "::ffff:192.0.2.1", true},
+		{[]string{"::ffff:192.0.2.0/120"}, "192.0.2.1", true},
+		{[]string{"::/0"}, "192.0.2.1", false},
+		{[]string{"0.0.0.0/0"}, "2001:db8::1", false},
+		{[]string{"0.0.0.0/0"}, "::ffff:0.0.0.0", true},
+
+		{nil, "192.0.2.1", false},
+	}
+	for _, test := range tests {
+		set := NewCIDRSet(mustParseCIDRs(t, test.cidrs...))
+		if got := set.Contains(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("%v contains %s = %v, want %v", test.cidrs, test.ip, got, test.want)
+		}
+	}
+}
+
+func TestCIDRSetNil(t *testing.T) {
+	var set *CIDRSet
+	if set.Contains(net.ParseIP("192.0.2.1")) {
+		t.Error("nil CIDRSet contains 192.0.2.1")
+	}
+	if NewCIDRSet(mustParseCIDRs(t, "0.0.0.0/0")).Contains(nil) {
+		t.Error("CIDRSet contains nil IP")
+	}
+}
+
+// TestCIDRSetMatchesIPNet checks CIDRSet against a linear search of the
+// same CIDRs, for random CIDRs and addresses near their boundaries
+func TestCIDRSetMatchesIPNet(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	for range 100 {
+		cidrs := randomCIDRs(r, 50)
+		set := NewCIDRSet(cidrs)
+		for _, cidr := range cidrs {
+			for _, ip := range boundaryIPs(cidr) {
+				want := false
+				for _, other := range cidrs {
+					if other.Contains(ip) {
+						want = true
+						break
+					}
+				}
+				if got := set.Contains(ip); got != want {
+					t.Fatalf("%v contains %s = %v, want %v", cidrs, ip, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestExcludedInsideAllowed(t *testing.T) {
+	backend := &TCPDialer{
+		Allowed:  NewCIDRSet(mustParseCIDRs(t, "10.0.0.0/8", "2001:db8::/32")),
+		Excluded: NewCIDRSet(mustParseCIDRs(t, "10.1.0.0/16", "10.2.3.4/32", "2001:db8:1::/48")),
+	}
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"10.0.255.255:443", true},
+		{"10.1.0.0:443", false},
+		{"10.1.255.255:443", false},
+		{"10.2.0.0:443", true},
+		{"10.2.3.3:443", true},
+		{"10.2.3.4:443", false},
+		{"10.2.3.5:443", true},
+		{"[::ffff:10.1.2.3]:443", false},
+		{"[::ffff:10.3.2.1]:443", true},
+		{"[2001:db8::1]:443", true},
+		{"[2001:db8:1::1]:443", false},
+		{"[2001:db8:2::1]:443", true},
+		{"11.0.0.1:443", false},
+	}
+	for _, test := range tests {
+		err := backend.checkBackend("example.com", test.address)
+		if test.allowed && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.address, err)
+		} else if !test.allowed && !errors.Is(err, errDisallowedBackend) {
+			t.Errorf("%s: got %v, want errDisallowedBackend", test.address, err)
+		}
+	}
+}
+
+func randomCIDRs(r *rand.Rand, n int) []*net.IPNet {
+	cidrs := make([]*net.IPNet, n)
+	for i := range cidrs {
+		var ip net.IP
+		var bits int
+		if r.IntN(2) == 0 {
+			ip = net.IPv4(10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256))).To4()
+			bits = 32
+		} else {
+			ip = net.ParseIP(fmt.Sprintf("2001:db8:%x::%x", r.IntN(4), r.IntN(65536)))
+			bits = 128
+		}
+		mask := net.CIDRMask(bits-r.IntN(bits/2), bits)
+		cidrs[i] = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	}
+	return cidrs
+}
+
+// boundaryIPs returns the first and last addresses of cidr, and the
+// addresses either side of them
+func boundaryIPs(cidr *net.IPNet) []net.IP {
+	first := cidr.IP
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^cidr.Mask[i]
+	}
+	return []net.IP{addToIP(first, -1), first, last, addToIP(last, 1)}
+}
+
+func addToIP(ip net.IP, delta int) net.IP {
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	for i := len(result) - 1; i >= 0; i-- {
+		sum := int(result[i]) + delta
+		result[i] = byte(sum)
+		if sum >= 0 && sum <= 255 {
+			break
+		}
+	}
+	return result
+}
+
+func BenchmarkCIDRSetContains(b *testing.B) {
+	r := rand.New(rand.NewPCG(1, 2))
+	set := NewCIDRSet(randomCIDRs(r, 10000))
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = net.IPv4(10, byte(r.IntN(4)), byte(r.IntN(256)), byte(r.IntN(256)))
+	}
+	for i := 0; b.Loop(); i++ {
+		set.Contains(ips[i%len(ips)])
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"slices"
+)
+
+const (
+	extensionPreSharedKey         = 41
+	extensionEncryptedClientHello = 0xfe0d
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+)
+
+// offersECH reports whether the client is using Encrypted Client Hello, in
+// which case clientHello.ServerName is the cleartext outer SNI, not the name
+// that the client actually wants to connect to
+func offersECH(clientHello *tls.ClientHelloInfo) bool {
+	return slices.Contains(clientHello.Extensions, extensionEncryptedClientHello)
+}
+
+// isGREASE reports whether value is one of the reserved GREASE values
+// (RFC 8701), which clients send to keep servers tolerant of unknown values
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// highestTLSVersion returns the highest TLS version offered by the client,
+// ignoring GREASE values
+func highestTLSVersion(clientHello *tls.ClientHelloInfo) uint16 {
+	var highest uint16
+	for _, version := range clientHello.SupportedVersions {
+		if !isGREASE(version) {
+			highest = max(highest, version)
+		}
+	}
+	return highest
+}
+
+// hasRealCipherSuite reports whether the client offers at least one
+// cipher suite which isn't a GREASE value.  A ClientHello without one is
+// almost certainly from a fuzzer or scanner, since no server could
+// complete the handshake.
+func hasRealCipherSuite(clientHello *tls.ClientHelloInfo) bool {
+	return slices.ContainsFunc(clientHello.CipherSuites, func(suite uint16) bool { return !isGREASE(suite) })
+}
+
+// helloReader consumes fields from a TLS ClientHello
+type helloReader []byte
+
+func (r *helloReader) bytes(n int) ([]byte, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b, true
+}
+
+func (r *helloReader) uint8() (int, bool) {
+	b, ok := r.bytes(1)
+	if !ok {
+		return 0, false
+	}
+	return int(b[0]), true
+}
+
+func (r *helloReader) uint16() (int, bool) {
+	b, ok := r.bytes(2)
+	if !ok {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(b)), true
+}
+
+func (r *helloReader) vector8() (helloReader, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(n)
+}
+
+func (r *helloReader) vector16() (helloReader, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	return r.bytes(n)
+}
+
+// clientHelloMessage reassembles the ClientHello handshake message (without
+// its 4 byte header) from the TLS records in raw, which may be followed by
+// other data
+func clientHelloMessage(raw []byte) ([]byte, bool) {
+	var message []byte
+	records := helloReader(raw)
+	for {
+		if len(message) >= 4 {
+			if message[0] != handshakeTypeClientHello {
+				return nil, false
+			}
+			length := int(message[1])<<16 | int(message[2])<<8 | int(message[3])
+			if len(message)-4 >= length {
+				return message[4 : 4+length], true
+			}
+		}
+		header, ok := records.bytes(5)
+		if !ok || header[0] != recordTypeHandshake {
+			return nil, false
+		}
+		fragment, ok := records.bytes(int(binary.BigEndian.Uint16(header[3:5])))
+		if !ok {
+			return nil, false
+		}
+		message = append(message, fragment...)
+	}
+}
+
+// clientHelloExtension returns the data of the given extension in the
+// ClientHello contained in raw
+func clientHelloExtension(raw []byte, extensionType int) ([]byte, bool) {
+	message, ok := clientHelloMessage(raw)
+	if !ok {
+		return nil, false
+	}
+	hello := helloReader(message)
+	if _, ok := hello.bytes(2 + 32); !ok { // legacy_version, random
+		return nil, false
+	}
+	if _, ok := hello.vector8(); !ok { // legacy_session_id
+		return nil, false
+	}
+	if _, ok := hello.vector16(); !ok { // cipher_suites
+		return nil, false
+	}
+	if _, ok := hello.vector8(); !ok { // legacy_compression_methods
+		return nil, false
+	}
+	extensions, ok := hello.vector16()
+	if !ok {
+		return nil, false
+	}
+	for len(extensions) > 0 {
+		typ, ok := extensions.uint16()
+		if !ok {
+			return nil, false
+		}
+		data, ok := extensions.vector16()
+		if !ok {
+			return nil, false
+		}
+		if typ == extensionType {
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+// pskIdentities returns the identities in the pre_shared_key extension of
+// the ClientHello contained in raw
+func pskIdentities(raw []byte) [][]byte {
+	data, ok := clientHelloExtension(raw, extensionPreSharedKey)
+	if !ok {
+		return nil
+	}
+	extension := helloReader(data)
+	identities, ok := extension.vector16()
+	if !ok {
+		return nil
+	}
+	var result [][]byte
+	for len(identities) > 0 {
+		identity, ok := identities.vector16()
+		if !ok {
+			return nil
+		}
+		if _, ok := identities.bytes(4); !ok { // obfuscated_ticket_age
+			return nil
+		}
+		result = append(result, identity)
+	}
+	return result
+}
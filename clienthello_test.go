@@ -0,0 +1,246 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordClientHello returns the ClientHello record which crypto/tls sends
+// to connect to serverName (or without SNI, if serverName is empty)
+func recordClientHello(tb testing.TB, serverName string) []byte {
+	tb.Helper()
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	go func() {
+		tls.Client(clientSide, &tls.Config{ServerName: serverName, InsecureSkipVerify: serverName == ""}).Handshake()
+		clientSide.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(serverSide, header); err != nil {
+		tb.Fatal(err)
+	}
+	record := make([]byte, 5+binary.BigEndian.Uint16(header[3:5]))
+	copy(record, header)
+	if _, err := io.ReadFull(serverSide, record[5:]); err != nil {
+		tb.Fatal(err)
+	}
+	return record
+}
+
+// withPSKIdentity returns a copy of the single-record ClientHello in
+// record with a pre_shared_key extension containing identity appended to
+// its extensions (pre_shared_key must be the last extension)
+func withPSKIdentity(record []byte, identity string) []byte {
+	var extension []byte
+	identities := binary.BigEndian.AppendUint16(nil, uint16(len(identity)))
+	identities = append(identities, identity...)
+	identities = append(identities, 0, 0, 0, 0) // obfuscated_ticket_age
+	extension = binary.BigEndian.AppendUint16(extension, uint16(len(identities)))
+	extension = append(extension, identities...)
+	binders := append([]byte{32}, make([]byte, 32)...)
+	extension = binary.BigEndian.AppendUint16(extension, uint16(len(binders)))
+	extension = append(extension, binders...)
+
+	added := binary.BigEndian.AppendUint16(nil, extensionPreSharedKey)
+	added = binary.BigEndian.AppendUint16(added, uint16(len(extension)))
+	added = append(added, extension...)
+
+	hello := bytes.Clone(record)
+	// Find the extensions length, which follows legacy_version, random,
+	// legacy_session_id, cipher_suites, and legacy_compression_methods
+	offset := 5 + 4 + 2 + 32
+	offset += 1 + int(hello[offset])
+	offset += 2 + int(binary.BigEndian.Uint16(hello[offset:]))
+	offset += 1 + int(hello[offset])
+	binary.BigEndian.PutUint16(hello[offset:], binary.BigEndian.Uint16(hello[offset:])+uint16(len(added)))
+	hello = append(hello, added...)
+
+	binary.BigEndian.PutUint16(hello[3:5], binary.BigEndian.Uint16(hello[3:5])+uint16(len(added)))
+	messageLength := int(hello[6])<<16 | int(hello[7])<<8 | int(hello[8]) + len(added)
+	hello[6], hello[7], hello[8] = byte(messageLength>>16), byte(messageLength>>8), byte(messageLength)
+	return hello
+}
+
+// splitRecords returns the single-record ClientHello in record split
+// across records with at most n bytes of the handshake message each
+func splitRecords(record []byte, n int) []byte {
+	var split []byte
+	for message := record[5:]; len(message) > 0; {
+		fragment := message[:min(n, len(message))]
+		message = message[len(fragment):]
+		split = append(split, record[:3]...)
+		split = binary.BigEndian.AppendUint16(split, uint16(len(fragment)))
+		split = append(split, fragment...)
+	}
+	return split
+}
+
+func TestPSKIdentities(t *testing.T) {
+	hello := recordClientHello(t, "example.com")
+	if identities := pskIdentities(hello); identities != nil {
+		t.Errorf("ClientHello without a PSK has identities %q", identities)
+	}
+	for _, raw := range [][]byte{
+		withPSKIdentity(hello, "route:backend.example"),
+		splitRecords(withPSKIdentity(hello, "route:backend.example"), 100),
+		append(withPSKIdentity(hello, "route:backend.example"), "application data"...),
+	} {
+		identities := pskIdentities(raw)
+		if len(identities) != 1 || string(identities[0]) != "route:backend.example" {
+			t.Errorf("pskIdentities = %q, want [route:backend.example]", identities)
+		}
+		if hostname, ok := pskRouteHostname(raw, "route:"); !ok || hostname != "backend.example" {
+			t.Errorf("pskRouteHostname = %q, %v, want backend.example", hostname, ok)
+		}
+		if _, ok := pskRouteHostname(raw, "other:"); ok {
+			t.Errorf("pskRouteHostname matched the wrong prefix")
+		}
+	}
+	withPSK := withPSKIdentity(hello, "route:backend.example")
+	for n := range len(withPSK) {
+		if identities := pskIdentities(withPSK[:n]); identities != nil {
+			t.Errorf("truncated to %d bytes, pskIdentities = %q", n, identities)
+		}
+	}
+}
+
+func TestPeekClientHelloPSKRoute(t *testing.T) {
+	server := &Server{PSKRoutePrefix: "route:"}
+	listener := NewMetrics().newListenerLabels(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443})
+	hello := withPSKIdentity(recordClientHello(t, "example.com"), "route:backend.example")
+	clientHello, helloBytes, err := peekBytes(server, listener, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clientHello.ServerName != "backend.example" {
+		t.Errorf("ServerName = %q, want backend.example", clientHello.ServerName)
+	}
+	if !bytes.Equal(helloBytes, hello) {
+		t.Errorf("peekClientHello returned %d bytes, want the %d of the ClientHello", len(helloBytes), len(hello))
+	}
+}
+
+// pipeConn is the server side of a net.Pipe.  Unlike a socket, a pipe
+// refuses to set deadlines once the client has closed its side, which is
+// how the client signals EOF in these tests, so that error is ignored.
+type pipeConn struct {
+	net.Conn
+}
+
+func (conn pipeConn) SetReadDeadline(t time.Time) error {
+	if err := conn.Conn.SetReadDeadline(t); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+		return err
+	}
+	return nil
+}
+
+// peekBytes runs peekClientHello on a connection from which the client
+// sends data and then closes its side
+func peekBytes(server *Server, listener listenerLabels, data []byte) (*tls.ClientHelloInfo, []byte, error) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	go func() {
+		clientSide.Write(data)
+		clientSide.Close()
+	}()
+	return server.peekClientHello(pipeConn{serverSide}, listener)
+}
+
+func FuzzPeekClientHello(f *testing.F) {
+	hello := recordClientHello(f, "example.com")
+	f.Add(hello)
+	f.Add(withPSKIdentity(hello, "route:backend.example"))
+	f.Add(splitRecords(hello, 64))
+	f.Add(hello[:len(hello)/2])
+	f.Add(recordClientHello(f, ""))
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	f.Add([]byte("\x16\x03\x01\x00\x00"))
+	f.Add([]byte{})
+
+	listener := NewMetrics().newListenerLabels(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		budget := &PeekBudget{Max: 4096}
+		server := &Server{PeekBudget: budget, PSKRoutePrefix: "route:", HeaderTimeout: 5 * time.Second}
+		clientHello, helloBytes, err := peekBytes(server, listener, data)
+		if used := budget.used.Load(); used != 0 {
+			t.Fatalf("%d bytes of the peek budget are still in use", used)
+		}
+		if err != nil {
+			if label := errorLabelValue(err); label == "other" {
+				t.Fatalf("peekClientHello error %q (%T) is labelled other", err, err)
+			}
+			return
+		}
+		if clientHello.ServerName == "" {
+			t.Fatal("peekClientHello succeeded without a ServerName or DefaultHostname")
+		}
+		if !bytes.HasPrefix(data, helloBytes) {
+			t.Fatal("peekClientHello returned bytes which the client didn't send")
+		}
+		if _, ok := clientHelloMessage(helloBytes); !ok {
+			t.Fatal("clientHelloMessage can't find the ClientHello which crypto/tls parsed")
+		}
+	})
+}
+
+func FuzzClientHelloMessage(f *testing.F) {
+	hello := recordClientHello(f, "example.com")
+	f.Add(hello)
+	f.Add(withPSKIdentity(hello, "route:backend.example"))
+	f.Add(splitRecords(withPSKIdentity(hello, "route:backend.example"), 16))
+	f.Add([]byte("\x16\x03\x01\x00\x00\x16\x03\x01\x00\x00"))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		message, ok := clientHelloMessage(raw)
+		if !ok {
+			if pskIdentities(raw) != nil {
+				t.Fatal("pskIdentities found identities without a ClientHello")
+			}
+			return
+		}
+		if len(message) > len(raw) {
+			t.Fatalf("ClientHello message is %d bytes, longer than the %d byte input", len(message), len(raw))
+		}
+		identities := pskIdentities(raw)
+		hostname, ok := pskRouteHostname(raw, "route:")
+		if ok && (len(identities) == 0 || string(identities[0]) != "route:"+hostname) {
+			t.Fatalf("pskRouteHostname = %q, but the first identity is %q", hostname, identities)
+		}
+		for _, identity := range identities {
+			if len(identity) > len(message) {
+				t.Fatalf("PSK identity is %d bytes, longer than the %d byte ClientHello", len(identity), len(message))
+			}
+		}
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// ClientConnLimit limits the number of concurrent connections from each
+// client IP address
+type ClientConnLimit struct {
+	Max int
+
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+}
+
+// Acquire counts a connection from addr, returning false if addr already
+// has Max connections.  If it returns true, the caller must call Release
+// with the same address when the connection closes.  Non-TCP addresses
+// are not limited.
+func (limit *ClientConnLimit) Acquire(addr net.Addr) bool {
+	ip, ok := clientIP(addr)
+	if !ok {
+		return true
+	}
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+	if limit.conns[ip] >= limit.Max {
+		return false
+	}
+	if limit.conns == nil {
+		limit.conns = make(map[netip.Addr]int)
+	}
+	limit.conns[ip]++
+	return true
+}
+
+func (limit *ClientConnLimit) Release(addr net.Addr) {
+	ip, ok := clientIP(addr)
+	if !ok {
+		return
+	}
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+	if limit.conns[ip] <= 1 {
+		delete(limit.conns, ip)
+	} else {
+		limit.conns[ip]--
+	}
+}
+
+func clientIP(addr net.Addr) (netip.Addr, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return tcpAddr.AddrPort().Addr().Unmap(), true
+}
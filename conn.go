@@ -0,0 +1,191 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// instrumentedConn wraps a backend connection to count the bytes
+// transferred over it
+type instrumentedConn struct {
+	BackendConn
+	backend      string
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	firstRead    atomic.Int64 // UnixNano of the first non-empty read
+
+	// If non-nil, incremented by the time spent in Write, which is
+	// mostly time spent blocked because the backend is slow to read
+	writeBlocked prometheus.Counter
+
+	// If maxBytes is non-zero, the connection is closed once more than
+	// maxBytes have been transferred, in each direction if
+	// maxBytesPerDirection is true, or in total otherwise
+	maxBytes             uint64
+	maxBytesPerDirection bool
+	maxBytesExceeded     atomic.Bool
+
+	lastActivity atomic.Int64 // UnixNano of the last non-empty read or write
+	idleTimedOut atomic.Bool
+
+	lifetimeExceeded atomic.Bool
+}
+
+// remainingBytes returns how many more bytes may be transferred in the
+// direction counted by transferred
+func (conn *instrumentedConn) remainingBytes(transferred *atomic.Uint64) uint64 {
+	if conn.maxBytes == 0 {
+		return math.MaxUint64
+	}
+	used := transferred.Load()
+	if !conn.maxBytesPerDirection {
+		used = conn.totalBytes()
+	}
+	if used >= conn.maxBytes {
+		return 0
+	}
+	return conn.maxBytes - used
+}
+
+func (conn *instrumentedConn) exceedMaxBytes() error {
+	conn.maxBytesExceeded.Store(true)
+	conn.BackendConn.Close()
+	return errByteLimitExceeded
+}
+
+func (conn *instrumentedConn) Read(p []byte) (int, error) {
+	remaining := conn.remainingBytes(&conn.bytesRead)
+	if uint64(len(p)) > remaining {
+		// Read one byte more than allowed to find out if the
+		// backend is trying to exceed the limit
+		p = p[:remaining+1]
+	}
+	n, err := conn.BackendConn.Read(p)
+	if n > 0 {
+		now := time.Now().UnixNano()
+		conn.firstRead.CompareAndSwap(0, now)
+		conn.lastActivity.Store(now)
+	}
+	if uint64(n) > remaining {
+		n = int(remaining)
+		err = conn.exceedMaxBytes()
+	}
+	conn.bytesRead.Add(uint64(n))
+	return n, err
+}
+
+func (conn *instrumentedConn) firstReadTime() time.Time {
+	if nanos := conn.firstRead.Load(); nanos != 0 {
+		return time.Unix(0, nanos)
+	}
+	return time.Time{}
+}
+
+func (conn *instrumentedConn) Write(p []byte) (int, error) {
+	exceeded := false
+	if remaining := conn.remainingBytes(&conn.bytesWritten); uint64(len(p)) > remaining {
+		p = p[:remaining]
+		exceeded = true
+	}
+	start := time.Now()
+	n, err := conn.BackendConn.Write(p)
+	if conn.writeBlocked != nil {
+		conn.writeBlocked.Add(time.Since(start).Seconds())
+	}
+	conn.bytesWritten.Add(uint64(n))
+	if n > 0 {
+		conn.lastActivity.Store(time.Now().UnixNano())
+	}
+	if exceeded && err == nil {
+		err = conn.exceedMaxBytes()
+	}
+	return n, err
+}
+
+// closeWhenIdle closes conn and clientConn once no data has been
+// transferred in either direction for timeout, until done is closed
+func (conn *instrumentedConn) closeWhenIdle(clientConn net.Conn, timeout time.Duration, done <-chan struct{}) {
+	conn.lastActivity.CompareAndSwap(0, time.Now().UnixNano())
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, conn.lastActivity.Load()))
+			if idle < timeout {
+				timer.Reset(timeout - idle)
+				continue
+			}
+			conn.idleTimedOut.Store(true)
+			conn.BackendConn.Close()
+			clientConn.Close()
+			return
+		}
+	}
+}
+
+func (conn *instrumentedConn) CloseWrite() error {
+	if closeWriter, ok := conn.BackendConn.(CloseWriter); ok {
+		return closeWriter.CloseWrite()
+	}
+	return conn.BackendConn.Close()
+}
+
+// totalBytes returns the number of bytes transferred in both directions,
+// saturating at math.MaxUint64 rather than wrapping around
+func (conn *instrumentedConn) totalBytes() uint64 {
+	read, written := conn.bytesRead.Load(), conn.bytesWritten.Load()
+	if read > math.MaxUint64-written {
+		return math.MaxUint64
+	}
+	return read + written
+}
+
+// writeFull writes all of p to w, retrying after short writes, which
+// io.Writer permits only when returning an error but which some
+// BackendConn implementations might do anyway
+func writeFull(w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n, err := w.Write(p)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		p = p[n:]
+	}
+	return nil
+}
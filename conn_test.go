@@ -0,0 +1,167 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+)
+
+// oneByteWriter accepts at most one byte per call to Write, as a slow
+// backend might
+type oneByteWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *oneByteWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.Buffer.Write(p[:1])
+}
+
+// zeroWriter never makes progress
+type zeroWriter struct{}
+
+func (zeroWriter) Write(p []byte) (int, error) { return 0, nil }
+
+func TestWriteFullShortWrites(t *testing.T) {
+	header := formatProxyHeaderV1(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443})
+	w := new(oneByteWriter)
+	if err := writeFull(w, header); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.Bytes(), header) {
+		t.Errorf("wrote %q, want %q", w.Bytes(), header)
+	}
+	if w.writes != len(header) {
+		t.Errorf("took %d writes, want %d", w.writes, len(header))
+	}
+}
+
+func TestWriteFullNoProgress(t *testing.T) {
+	if err := writeFull(zeroWriter{}, []byte("PROXY")); !errors.Is(err, io.ErrShortWrite) {
+		t.Errorf("got %v, want io.ErrShortWrite", err)
+	}
+	if err := writeFull(zeroWriter{}, nil); err != nil {
+		t.Errorf("writing nothing: %v", err)
+	}
+}
+
+func TestProxyHeaderWriteErrorLabel(t *testing.T) {
+	err := &BackendError{Backend: "example.com", Err: errors.Join(errProxyHeaderWrite, io.ErrShortWrite)}
+	if label := errorLabelValue(err); label != "backend-proxy-header" {
+		t.Errorf("label = %q, want backend-proxy-header", label)
+	}
+}
+
+func TestFormatProxyHeaderAddresses(t *testing.T) {
+	tests := []struct {
+		remote, local net.Addr
+		want          string
+		wantV2Local   bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 0}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 65535}, "PROXY TCP4 192.0.2.1 198.51.100.1 0 65535\r\n", false},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("::ffff:198.51.100.1"), Port: 443}, "PROXY TCP4 192.0.2.1 198.51.100.1 1 443\r\n", false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, "PROXY TCP6 2001:db8::1 2001:db8::2 1 443\r\n", false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443}, "PROXY UNKNOWN\r\n", false},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, &net.UnixAddr{Name: "/run/snid.sock", Net: "unix"}, "PROXY UNKNOWN\r\n", true},
+	}
+	for _, test := range tests {
+		if got := string(formatProxyHeaderV1(test.remote, test.local)); got != test.want {
+			t.Errorf("formatProxyHeaderV1(%s, %s) = %q, want %q", test.remote, test.local, got, test.want)
+		}
+		header, err := readProxyHeader(bytes.NewReader(formatProxyHeader(test.remote, test.local, nil)))
+		if err != nil {
+			t.Errorf("formatProxyHeader(%s, %s): %s", test.remote, test.local, err)
+			continue
+		}
+		if test.wantV2Local {
+			if header.RemoteAddr != nil {
+				t.Errorf("formatProxyHeader(%s, %s) has addresses %s, want LOCAL", test.remote, test.local, header.RemoteAddr)
+			}
+		} else if remote := test.remote.(*net.TCPAddr); !header.RemoteAddr.IP.Equal(remote.IP) || header.RemoteAddr.Port != remote.Port {
+			t.Errorf("formatProxyHeader(%s, %s) has remote address %s", test.remote, test.local, header.RemoteAddr)
+		}
+	}
+}
+
+const terabyte = 1 << 40
+
+func TestTotalBytesLarge(t *testing.T) {
+	tests := []struct {
+		read, written uint64
+		want          uint64
+	}{
+		{0, 0, 0},
+		{5 * terabyte, 3 * terabyte, 8 * terabyte},
+		{math.MaxUint64 - 1, 1, math.MaxUint64},
+		{math.MaxUint64, 1, math.MaxUint64},
+		{1, math.MaxUint64, math.MaxUint64},
+		{math.MaxUint64, math.MaxUint64, math.MaxUint64},
+		{math.MaxUint64/2 + 1, math.MaxUint64/2 + 1, math.MaxUint64},
+	}
+	for _, test := range tests {
+		conn := new(instrumentedConn)
+		conn.bytesRead.Store(test.read)
+		conn.bytesWritten.Store(test.written)
+		if got := conn.totalBytes(); got != test.want {
+			t.Errorf("totalBytes with %d read and %d written = %d, want %d", test.read, test.written, got, test.want)
+		}
+	}
+}
+
+func TestRemainingBytesLarge(t *testing.T) {
+	tests := []struct {
+		maxBytes     uint64
+		perDirection bool
+		read         uint64
+		written      uint64
+		want         uint64
+	}{
+		{0, false, math.MaxUint64, math.MaxUint64, math.MaxUint64},
+		{10 * terabyte, false, 4 * terabyte, 4 * terabyte, 2 * terabyte},
+		{10 * terabyte, false, 6 * terabyte, 6 * terabyte, 0},
+		{10 * terabyte, true, 6 * terabyte, 6 * terabyte, 4 * terabyte},
+		{math.MaxUint64, false, math.MaxUint64, 1, 0},
+		{math.MaxUint64, false, math.MaxUint64 - 2, 1, 1},
+		{math.MaxUint64, true, math.MaxUint64 - 1, math.MaxUint64, 1},
+	}
+	for _, test := range tests {
+		conn := &instrumentedConn{maxBytes: test.maxBytes, maxBytesPerDirection: test.perDirection}
+		conn.bytesRead.Store(test.read)
+		conn.bytesWritten.Store(test.written)
+		if got := conn.remainingBytes(&conn.bytesRead); got != test.want {
+			t.Errorf("remainingBytes with limit %d (per direction %v), %d read, and %d written = %d, want %d", test.maxBytes, test.perDirection, test.read, test.written, got, test.want)
+		}
+	}
+}
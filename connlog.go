@@ -0,0 +1,115 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// Values of Server.LogConnections
+const (
+	LogConnectionsAll    = "all"    // log every connection when it closes
+	LogConnectionsErrors = "errors" // log only connections which failed (the default)
+	LogConnectionsNone   = "none"   // log no connections
+)
+
+func parseLogConnections(arg string) (string, error) {
+	switch arg {
+	case LogConnectionsAll, LogConnectionsErrors, LogConnectionsNone:
+		return arg, nil
+	default:
+		return "", fmt.Errorf("must be %s, %s, or %s", LogConnectionsAll, LogConnectionsErrors, LogConnectionsNone)
+	}
+}
+
+// connOutcome records how a connection ended, so that it can be logged
+// when it closes
+type connOutcome struct {
+	err      error  // non-nil if the connection failed
+	quiet    bool   // err is routine (e.g. a scanner disconnecting) and only logged with LogConnectionsAll
+	observed bool   // the connection was allowed, but not proxied, because of Server.ObserveOnly
+	country  string // the client's country, if Server.GeoIP is set
+	traceID  string // the trace ID of the connection's span, if Server.Tracer is set
+
+	backendConn *instrumentedConn // nil if the backend wasn't connected
+}
+
+// logEstablished logs the backend which a connection was proxied to, when
+// LogConnections is LogConnectionsAll, so that it can be audited which
+// backend each hostname reached
+func (server *Server) logEstablished(clientAddr net.Addr, serverName string, listener listenerLabels, backendAddr net.Addr) {
+	if server.LogConnections != LogConnectionsAll {
+		return
+	}
+	log.Printf("Connection from %s to %q on %s established to backend %s", clientAddr, serverName, listener.name, backendAddr)
+}
+
+// logConnection logs a closed connection according to LogConnections.
+// Failed connections are also subject to RejectLogSampleRate.
+func (server *Server) logConnection(clientAddr net.Addr, serverName string, start time.Time, outcome *connOutcome) {
+	switch server.LogConnections {
+	case LogConnectionsNone:
+		return
+	case LogConnectionsAll:
+	default:
+		if outcome.err == nil || outcome.quiet {
+			return
+		}
+	}
+	duration := time.Since(start).Round(time.Millisecond)
+	client := clientAddr.String()
+	if outcome.country != "" {
+		client += " (" + outcome.country + ")"
+	}
+	if outcome.err != nil {
+		if server.RejectLogSampleRate != 0 && rand.Float64() >= server.RejectLogSampleRate {
+			return
+		}
+		log.Printf("Connection from %s to %q failed after %s: %s", client, serverName, duration, outcome.err)
+	} else if outcome.observed {
+		log.Printf("Connection from %s to %q closed after %s: observed only", client, serverName, duration)
+	} else {
+		log.Printf("Connection from %s to %q closed after %s: %d bytes from client, %d bytes from backend", client, serverName, duration, outcome.backendConn.bytesWritten.Load(), outcome.backendConn.bytesRead.Load())
+	}
+}
+
+// auditConnection records a closed connection in AuditLog, regardless of
+// LogConnections
+func (server *Server) auditConnection(clientAddr net.Addr, serverName string, outcome *connOutcome) {
+	if server.AuditLog == nil {
+		return
+	}
+	record := &AuditRecord{Time: time.Now(), ClientAddr: clientAddr.String(), Country: outcome.country, ServerName: serverName, Outcome: "ok"}
+	if outcome.err != nil {
+		record.Outcome = errorLabelValue(outcome.err)
+		record.Error = outcome.err.Error()
+	}
+	server.AuditLog.Record(record)
+}
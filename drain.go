@@ -0,0 +1,167 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// SetDraining sets whether the server is draining.  While draining, the
+// server closes new connections as soon as they're accepted (rather than
+// leaving them to hang in the listen backlog), but continues to handle
+// the connections it had already accepted.
+func (server *Server) SetDraining(draining bool) {
+	server.draining.Store(draining)
+}
+
+// WatchDrainFile calls setDraining(true) when a file exists at path, and
+// setDraining(false) when it's removed
+func WatchDrainFile(path string, setDraining func(bool)) error {
+	path = filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch the parent directory, since the file itself needn't exist
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	draining, err := fileExists(path)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	if draining {
+		log.Printf("Draining because %s exists", path)
+		setDraining(true)
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path {
+					continue
+				}
+				exists, err := fileExists(path)
+				if err != nil {
+					log.Printf("Error checking drain file %s: %s", path, err)
+					continue
+				}
+				if exists == draining {
+					continue
+				}
+				draining = exists
+				if draining {
+					log.Printf("Draining because %s was created", path)
+				} else {
+					log.Printf("Resuming because %s was removed", path)
+				}
+				setDraining(draining)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching drain file %s: %s", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func fileExists(path string) (bool, error) {
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DrainedBackends is a set of hostnames whose backends aren't dialed for
+// new connections, so that they can be taken out of service without
+// affecting other backends or existing connections
+type DrainedBackends struct {
+	mu        sync.RWMutex
+	hostnames map[string]struct{}
+}
+
+// SetDrained adds hostname to or removes it from the set
+func (drained *DrainedBackends) SetDrained(hostname string, isDrained bool) error {
+	hostname, err := canonicalizeHostname(hostname)
+	if err != nil {
+		return err
+	}
+	drained.mu.Lock()
+	defer drained.mu.Unlock()
+	if isDrained {
+		if drained.hostnames == nil {
+			drained.hostnames = make(map[string]struct{})
+		}
+		drained.hostnames[hostname] = struct{}{}
+	} else {
+		delete(drained.hostnames, hostname)
+	}
+	return nil
+}
+
+// IsDrained reports whether hostname is in the set.  A nil
+// DrainedBackends is empty.
+func (drained *DrainedBackends) IsDrained(origHostname string) bool {
+	if drained == nil {
+		return false
+	}
+	hostname, err := canonicalizeHostname(origHostname)
+	if err != nil {
+		return false
+	}
+	drained.mu.RLock()
+	defer drained.mu.RUnlock()
+	_, ok := drained.hostnames[hostname]
+	return ok
+}
+
+// List returns the hostnames in the set, sorted
+func (drained *DrainedBackends) List() []string {
+	drained.mu.RLock()
+	defer drained.mu.RUnlock()
+	return slices.Sorted(maps.Keys(drained.hostnames))
+}
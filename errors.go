@@ -0,0 +1,212 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errDisallowedBackend = errors.New("not an allowed backend")
+
+var errFirstByteTimeout = errors.New("client did not send anything in time")
+
+var errProxyHeaderWrite = errors.New("writing PROXY header failed")
+
+var errPreambleWrite = errors.New("writing preamble failed")
+
+var errProxyHeaderRead = errors.New("reading PROXY header from client failed")
+
+var errClientConnLimit = errors.New("client has too many connections")
+
+var errIPLiteralSNI = errors.New("SNI hostname is an IP address")
+
+var errIdleTimeout = errors.New("connection was idle for too long")
+
+var errSNIDenied = errors.New("SNI hostname is not allowed")
+
+var errInvalidSNI = errors.New("SNI hostname is not a valid hostname")
+
+var errByteLimitExceeded = errors.New("connection exceeded its byte limit")
+
+var errBogusHello = errors.New("ClientHello offers no cipher suites")
+
+var errInvalidHello = errors.New("client did not send a valid TLS ClientHello")
+
+var errTLSTooOld = errors.New("client does not offer a recent enough TLS version")
+
+var errNoALPN = errors.New("client did not offer any ALPN protocols")
+
+var errLookupLimit = errors.New("too many DNS lookups in flight")
+
+var errLoopDetected = errors.New("one of snid's own listeners")
+
+var errAllBackendsDown = errors.New("all of the backend's addresses are down")
+
+var errInvalidIDN = errors.New("SNI hostname is not a valid internationalized domain name")
+
+// errObserved is returned by BackendDialers in observe-only mode once they
+// have decided on a backend address, instead of connecting to it
+var errObserved = errors.New("not connecting in observe-only mode")
+
+var errBackendDrained = errors.New("backend is drained")
+
+// errBackendNotFound is returned by BackendDialers when there is no
+// backend for the hostname
+var errBackendNotFound = errors.New("no backend found")
+
+// BackendError wraps an error which occurred while connecting or talking
+// to the backend, as opposed to the client
+type BackendError struct {
+	Backend string
+
+	// If non-empty, the address that snid tried to connect to, which is
+	// empty if the error occurred before connecting (e.g. in DNS)
+	Address string
+
+	// If non-zero, how long dialing the backend took before failing
+	DialDuration time.Duration
+
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "backend %s", e.Backend)
+	if e.Address != "" {
+		fmt.Fprintf(&b, " (%s)", e.Address)
+	}
+	if e.DialDuration != 0 {
+		fmt.Fprintf(&b, " after %s", e.DialDuration.Round(time.Millisecond))
+	}
+	fmt.Fprintf(&b, ": %s", e.Err)
+	return b.String()
+}
+
+// dialedAddress returns the address which a dial error occurred while
+// connecting to, or the empty string if it didn't get that far
+func dialedAddress(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Addr != nil {
+		return opErr.Addr.String()
+	}
+	return ""
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errorLabelValue classifies err into a low-cardinality value suitable
+// for a metric label
+func errorLabelValue(err error) string {
+	var backendErr *BackendError
+	if errors.As(err, &backendErr) {
+		var dnsErr *net.DNSError
+		switch {
+		case errors.Is(err, errProxyHeaderWrite):
+			return "backend-proxy-header"
+		case errors.Is(err, errPreambleWrite):
+			return "backend-preamble"
+		case errors.Is(err, errBackendDrained):
+			return "backend-drained"
+		case errors.Is(err, errLookupLimit):
+			return "backend-lookup-shed"
+		case errors.Is(err, errLoopDetected):
+			return "loop-detected"
+		case errors.Is(err, errDisallowedBackend):
+			return "disallowed-backend"
+		case errors.Is(err, errPTRMismatch):
+			return "ptr-mismatch"
+		case errors.Is(err, errAllBackendsDown):
+			return "all-backends-down"
+		case errors.Is(err, errBackendNotFound), errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+			return "backend-not-found"
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return "backend-refused"
+		case isTimeout(err):
+			return "backend-timeout"
+		default:
+			return "backend-error"
+		}
+	}
+
+	var recordHeaderErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	switch {
+	case errors.Is(err, errProxyHeaderRead):
+		return "client-proxy-header"
+	case errors.Is(err, errClientConnLimit):
+		return "client-conn-limit"
+	case errors.Is(err, errPeekMemoryExhausted):
+		return "peek-memory-exhausted"
+	case errors.Is(err, errByteLimitExceeded):
+		return "byte-limit-exceeded"
+	case errors.Is(err, errIdleTimeout):
+		return "idle-timeout"
+	case errors.Is(err, errLifetimeExceeded):
+		return "max-lifetime"
+	case errors.Is(err, errInvalidLifetimeHint):
+		return "invalid-lifetime-hint"
+	case errors.Is(err, errNoSNI):
+		return "no-sni"
+	case errors.Is(err, errIPLiteralSNI):
+		return "ip-literal-sni"
+	case errors.Is(err, errInvalidSNI):
+		return "invalid-sni"
+	case errors.Is(err, errSNIDenied):
+		return "sni-denied"
+	case errors.Is(err, errInvalidIDN):
+		return "invalid-idn"
+	case errors.Is(err, errBogusHello):
+		return "bogus-hello"
+	case errors.Is(err, errTLSTooOld):
+		return "tls-too-old"
+	case errors.Is(err, errNoALPN):
+		return "no-alpn"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, errFirstByteTimeout):
+		return "first-byte-timeout"
+	case isTimeout(err):
+		return "timeout"
+	case errors.Is(err, errInvalidHello), errors.As(err, &recordHeaderErr), errors.As(err, &alertErr):
+		return "tls-invalid"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPlainHTTPCountedAsTLSInvalid(t *testing.T) {
+	metrics := NewMetrics()
+	listener := metrics.newListenerLabels(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443})
+	server := &Server{Metrics: metrics, HeaderTimeout: 5 * time.Second, LogConnections: LogConnectionsNone}
+	invalid := listener.metrics.errors.WithLabelValues("tls-invalid")
+
+	// A client speaking plain HTTP to a TLS port, sent all at once and
+	// split across writes, with and without closing its side afterwards
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	tests := []struct {
+		name   string
+		writes []string
+		close  bool
+	}{
+		{"whole", []string{request}, true},
+		{"split", []string{request[:3], request[3:]}, true},
+		{"open", []string{request}, false},
+	}
+	for _, test := range tests {
+		before := metricValue(t, invalid).GetCounter().GetValue()
+		clientSide, serverSide := net.Pipe()
+		go func() {
+			for _, data := range test.writes {
+				if _, err := io.WriteString(clientSide, data); err != nil {
+					return
+				}
+			}
+			if test.close {
+				clientSide.Close()
+			}
+		}()
+		server.handleConnection(pipeConn{serverSide}, listener)
+		clientSide.Close()
+		if got := metricValue(t, invalid).GetCounter().GetValue() - before; got != 1 {
+			t.Errorf("%s: tls-invalid errors increased by %g, want 1", test.name, got)
+		}
+	}
+}
+
+func TestErrorLabelValue(t *testing.T) {
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{io.EOF, "eof"},
+		{io.ErrUnexpectedEOF, "eof"},
+		{timeout, "timeout"},
+		{fmt.Errorf("%w: %w", errFirstByteTimeout, timeout), "first-byte-timeout"},
+		{fmt.Errorf("%w: %w", errProxyHeaderRead, io.EOF), "client-proxy-header"},
+		{errNoSNI, "no-sni"},
+		{tls.AlertError(80), "tls-invalid"},
+		{errors.New("something else"), "other"},
+		{&BackendError{Backend: "example.com", Err: fmt.Errorf("%w: %w", errProxyHeaderWrite, io.ErrShortWrite)}, "backend-proxy-header"},
+		{&BackendError{Backend: "example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, "backend-refused"},
+		{&BackendError{Backend: "example.com", Err: timeout}, "backend-timeout"},
+		{&BackendError{Backend: "example.com", Err: &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}}, "backend-not-found"},
+		{&BackendError{Backend: "example.com", Err: errDisallowedBackend}, "disallowed-backend"},
+		{&BackendError{Backend: "example.com", Err: errors.New("something else")}, "backend-error"},
+
+		// Wrapped several levels deep
+		{fmt.Errorf("dial: %w", &BackendError{Backend: "example.com", Err: fmt.Errorf("x: %w", io.EOF)}), "backend-error"},
+		{fmt.Errorf("dial: %w", &BackendError{Backend: "example.com", Err: fmt.Errorf("%w: %w", errAllBackendsDown, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED})}), "all-backends-down"},
+		{fmt.Errorf("proxying: %w", fmt.Errorf("dial: %w", &BackendError{Backend: "example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}})), "backend-refused"},
+		{fmt.Errorf("peeking: %w", fmt.Errorf("%w: %w", errFirstByteTimeout, timeout)), "first-byte-timeout"},
+		{fmt.Errorf("peeking: %w", fmt.Errorf("reading: %w", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"})), "tls-invalid"},
+		{fmt.Errorf("%w: %w", errInvalidHello, errors.New("tls: unexpected message")), "tls-invalid"},
+		// A malformed record from the backend is the backend's fault, not
+		// the client's
+		{&BackendError{Backend: "example.com", Err: tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}}, "backend-error"},
+		{fmt.Errorf("dial: %w", &BackendError{Backend: "example.com", Err: fmt.Errorf("x: %w", tls.RecordHeaderError{})}), "backend-error"},
+
+		// Joined with other errors
+		{errors.Join(errors.New("closing"), &BackendError{Backend: "example.com", Err: timeout}), "backend-timeout"},
+		{errors.Join(io.EOF, &BackendError{Backend: "example.com", Err: errDisallowedBackend}), "disallowed-backend"},
+		{&BackendError{Backend: "example.com", Err: errors.Join(errors.New("target.example.com: something else"), &net.DNSError{Err: "no such host", Name: "other.example.com", IsNotFound: true})}, "backend-not-found"},
+		{errors.Join(errors.New("closing"), fmt.Errorf("x: %w", tls.RecordHeaderError{})), "tls-invalid"},
+		{errors.Join(errors.New("closing"), io.EOF), "eof"},
+	}
+	for _, test := range tests {
+		if label := errorLabelValue(test.err); label != test.want {
+			t.Errorf("errorLabelValue(%v) = %q, want %q", test.err, label, test.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// GeoIP looks up the countries of client addresses in a MaxMind GeoIP
+// (or compatible) database
+type GeoIP struct {
+	reader *maxminddb.Reader
+}
+
+// OpenGeoIP opens the database at path, which is read into memory once and
+// never reloaded
+func OpenGeoIP(path string) (*GeoIP, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &GeoIP{reader: reader}, nil
+}
+
+func (geoip *GeoIP) Close() error {
+	return geoip.reader.Close()
+}
+
+// Country returns the ISO 3166-1 country code of addr, "private" if addr
+// is a private, loopback, or link-local address, or "unknown" if it is
+// not a TCP address or isn't in the database.  Only upper-case two-letter
+// codes are ever returned, so the result is safe to use as a metric label.
+func (geoip *GeoIP) Country(addr net.Addr) string {
+	ip, ok := clientIP(addr)
+	if !ok {
+		return "unknown"
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return "private"
+	}
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		RegisteredCountry struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"registered_country"`
+	}
+	if err := geoip.reader.Lookup(net.IP(ip.AsSlice()), &record); err != nil {
+		return "unknown"
+	}
+	code := record.Country.ISOCode
+	if code == "" {
+		code = record.RegisteredCountry.ISOCode
+	}
+	if !isCountryCode(code) {
+		return "unknown"
+	}
+	return code
+}
+
+func isCountryCode(code string) bool {
+	return len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z'
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const startupProbeInterval = 5 * time.Second
+
+// Readiness is an http.Handler which reports whether snid is ready to
+// serve traffic
+type Readiness struct {
+	ready         atomic.Bool
+	draining      atomic.Bool
+	proxyMismatch atomic.Bool
+	warming       atomic.Bool
+}
+
+func (readiness *Readiness) SetReady(ready bool) {
+	readiness.ready.Store(ready)
+}
+
+// SetDraining sets whether snid is draining, in which case it's not ready
+// regardless of SetReady
+func (readiness *Readiness) SetDraining(draining bool) {
+	readiness.draining.Store(draining)
+}
+
+// SetProxyMismatch sets whether the PROXY protocol probe found that the
+// backend rejects the PROXY header, in which case snid is not ready.  It
+// returns the previous value.
+func (readiness *Readiness) SetProxyMismatch(mismatch bool) bool {
+	return readiness.proxyMismatch.Swap(mismatch)
+}
+
+// SetWarming sets whether snid is warming up after starting, in which case
+// it's not ready and Server closes connections as soon as they're accepted.
+// It returns the previous value.
+func (readiness *Readiness) SetWarming(warming bool) bool {
+	return readiness.warming.Swap(warming)
+}
+
+func (readiness *Readiness) IsReady() bool {
+	return readiness.ready.Load() && !readiness.draining.Load() && !readiness.proxyMismatch.Load() && !readiness.warming.Load()
+}
+
+func (readiness *Readiness) IsWarming() bool {
+	return readiness != nil && readiness.warming.Load()
+}
+
+func (readiness *Readiness) IsDraining() bool {
+	return readiness.draining.Load()
+}
+
+func (readiness *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if readiness.IsReady() {
+		http.Error(w, "ready", http.StatusOK)
+	} else {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}
+}
+
+// probeClientConn stands in for a client connection when dialing the
+// backend for the startup probe
+type probeClientConn struct {
+	addr net.Addr
+}
+
+func (conn probeClientConn) LocalAddr() net.Addr  { return conn.addr }
+func (conn probeClientConn) RemoteAddr() net.Addr { return conn.addr }
+
+// runStartupProbe dials hostname through backend until it succeeds, and
+// then marks snid as ready
+func runStartupProbe(backend BackendDialer, hostname string, clientConn ClientConn, readiness *Readiness) {
+	for {
+		conn, err := backend.Dial(hostname, nil, clientConn)
+		if err == nil || errors.Is(err, errObserved) {
+			if conn != nil {
+				conn.Close()
+			}
+			log.Printf("Startup probe of %s succeeded", hostname)
+			readiness.SetReady(true)
+			if readiness.SetWarming(false) {
+				log.Print("Warmup ended early because the startup probe succeeded")
+			}
+			return
+		}
+		log.Printf("Startup probe of %s failed: %s", hostname, err)
+		time.Sleep(startupProbeInterval)
+	}
+}
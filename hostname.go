@@ -27,9 +27,23 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strings"
+
+	"golang.org/x/net/idna"
 )
 
+// idnaProfile converts internationalized hostnames to ASCII using the
+// IDNA2008 lookup rules, but without the STD3 and hyphen rules, which
+// reject hostnames that are valid in SNI, such as ones containing
+// underscores or "--" in the third and fourth positions of a label
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false), idna.CheckHyphens(false))
+
+// normalizeIDN returns the ASCII form of the internationalized hostname
+func normalizeIDN(hostname string) (string, error) {
+	return idnaProfile.ToASCII(hostname)
+}
+
 func replaceFirstLabel(hostname string, replacement string) string {
 	dot := strings.IndexByte(hostname, '.')
 	if dot == -1 {
@@ -50,6 +64,43 @@ func canonicalizeHostname(hostname string) (string, error) {
 	return hostname, nil
 }
 
+// checkFQDN returns an error unless hostname is a syntactically valid DNS
+// hostname consisting of letters, digits, and hyphens, with at least two
+// labels unless allowSingleLabel is true
+func checkFQDN(hostname string, allowSingleLabel bool) error {
+	if len(hostname) > 253 {
+		return errors.New("hostname is too long")
+	}
+	labels := strings.Split(hostname, ".")
+	if len(labels) == 1 && !allowSingleLabel {
+		return errors.New("hostname is not fully-qualified")
+	}
+	for _, label := range labels {
+		if err := checkHostnameLabel(label); err != nil {
+			return fmt.Errorf("label %q: %w", label, err)
+		}
+	}
+	return nil
+}
+
+func checkHostnameLabel(label string) error {
+	if len(label) == 0 {
+		return errors.New("label is empty")
+	}
+	if len(label) > 63 {
+		return errors.New("label is too long")
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return errors.New("label starts or ends with a hyphen")
+	}
+	for _, c := range []byte(label) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return fmt.Errorf("invalid character %q", c)
+		}
+	}
+	return nil
+}
+
 func wildcardHostname(hostname string) string {
 	return replaceFirstLabel(hostname, "_")
 }
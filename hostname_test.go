@@ -0,0 +1,62 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import "testing"
+
+func TestNormalizeIDN(t *testing.T) {
+	tests := []struct {
+		hostname string
+		want     string // empty if the hostname is invalid
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example", "xn--bcher-kva.example"},
+		{"_acme-challenge.example.com", "_acme-challenge.example.com"},
+		{"ab--cd.example.com", "ab--cd.example.com"},
+		{"-leading.example.com", "-leading.example.com"},
+		{"trailing-.example.com", "trailing-.example.com"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"1א.example", ""},       // violates the Bidi rule
+		{"a\u200db.example", ""}, // joiner out of context
+		{"xn--zz.example", ""},   // invalid punycode
+		{"a\u2028b.example", ""}, // disallowed code point
+	}
+	for _, test := range tests {
+		got, err := normalizeIDN(test.hostname)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("normalizeIDN(%q) = %q, want error", test.hostname, got)
+			}
+		} else if err != nil {
+			t.Errorf("normalizeIDN(%q): unexpected error: %s", test.hostname, err)
+		} else if got != test.want {
+			t.Errorf("normalizeIDN(%q) = %q, want %q", test.hostname, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var errHTTPConnect = errors.New("HTTP CONNECT proxy did not establish a tunnel")
+
+// httpConnectTimeout limits the CONNECT handshake with the proxy when
+// there is no dial timeout, so that a proxy which never responds can't
+// hold a connection open forever.  (It's a variable so that tests can
+// shorten it.)
+var httpConnectTimeout = 10 * time.Second
+
+// targetControlError wraps an error returned by the dialer's Control
+// function for the target of an HTTP CONNECT request, so that it can be
+// reported against the target's address rather than the proxy's
+type targetControlError struct {
+	err error
+}
+
+func (e *targetControlError) Error() string { return e.err.Error() }
+func (e *targetControlError) Unwrap() error { return e.err }
+
+// dialContext dials address, through HTTPConnectProxy if it's set
+func (backend *TCPDialer) dialContext(ctx context.Context, dialer net.Dialer, address string) (BackendConn, error) {
+	if backend.HTTPConnectProxy == "" {
+		conn, err := dialer.DialContext(ctx, backend.network(), address)
+		if err != nil {
+			return nil, err
+		}
+		return conn.(*net.TCPConn), nil
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return backend.dialHTTPConnect(ctx, dialer, address)
+	}
+	// Resolve the target here, rather than leaving it to the proxy, so
+	// that the dialer's Control function can check the address
+	ips, err := backend.Resolver.LookupNetIP(ctx, backend.ipNetwork(), host)
+	if err != nil {
+		return nil, err
+	}
+	return backend.dialAddresses(ctx, dialer, ips, port)
+}
+
+// dialHTTPConnect connects to HTTPConnectProxy and asks it to open a
+// tunnel to target, which must be an IP address and port.  The dialer's
+// Control function is applied to the proxy socket, but as if it were
+// connecting to target, so that the backend checks apply to target.
+func (backend *TCPDialer) dialHTTPConnect(ctx context.Context, dialer net.Dialer, target string) (BackendConn, error) {
+	if control := dialer.Control; control != nil {
+		dialer.Control = func(network string, address string, c syscall.RawConn) error {
+			if err := control(network, target, c); err != nil {
+				return &targetControlError{err: err}
+			}
+			return nil
+		}
+	}
+	conn, err := dialer.DialContext(ctx, backend.network(), backend.HTTPConnectProxy)
+	if err != nil {
+		var controlErr *targetControlError
+		if errors.As(err, &controlErr) {
+			addr, _ := net.ResolveTCPAddr(backend.network(), target)
+			return nil, &net.OpError{Op: "dial", Net: backend.network(), Addr: addr, Err: controlErr.err}
+		}
+		return nil, fmt.Errorf("connecting to HTTP CONNECT proxy: %w", err)
+	}
+	tcpConn := conn.(*net.TCPConn)
+	if err := backend.httpConnect(ctx, dialer.Timeout, tcpConn, target); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return tcpConn, nil
+}
+
+func (backend *TCPDialer) httpConnect(ctx context.Context, timeout time.Duration, conn net.Conn, target string) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		if timeout == 0 {
+			timeout = httpConnectTimeout
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	var request strings.Builder
+	fmt.Fprintf(&request, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	for _, header := range backend.HTTPConnectHeaders {
+		fmt.Fprintf(&request, "%s\r\n", header)
+	}
+	request.WriteString("\r\n")
+	if _, err := conn.Write([]byte(request.String())); err != nil {
+		return fmt.Errorf("%w: %w", errHTTPConnect, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return fmt.Errorf("%w: %w", errHTTPConnect, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: proxy responded %s to CONNECT %s", errHTTPConnect, resp.Status, target)
+	}
+	// A TLS server never speaks first, so anything after the response
+	// means the proxy is confused
+	if reader.Buffered() != 0 {
+		return fmt.Errorf("%w: proxy sent unexpected data after its response", errHTTPConnect)
+	}
+	return conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeConnectProxy is an HTTP CONNECT proxy which responds to each
+// request with status, and then, if status is 200, echoes the tunnel back
+// instead of connecting anywhere.  If status is empty, it never responds.
+type fakeConnectProxy struct {
+	listener net.Listener
+	status   string
+	requests chan *http.Request
+}
+
+func newFakeConnectProxy(t *testing.T, status string) *fakeConnectProxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	proxy := &fakeConnectProxy{listener: listener, status: status, requests: make(chan *http.Request, 10)}
+	go proxy.serve()
+	return proxy
+}
+
+func (proxy *fakeConnectProxy) serve() {
+	for {
+		conn, err := proxy.listener.Accept()
+		if err != nil {
+			return
+		}
+		go proxy.handle(conn)
+	}
+}
+
+func (proxy *fakeConnectProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	proxy.requests <- request
+	if proxy.status == "" {
+		io.Copy(io.Discard, reader)
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 "+proxy.status+"\r\n\r\n"); err != nil {
+		return
+	}
+	if proxy.status == "200 Connection established" {
+		io.Copy(conn, reader)
+	}
+}
+
+func (proxy *fakeConnectProxy) dialer(t *testing.T, route string) *TCPDialer {
+	routes := NewRouteTable()
+	routes.Set("example.com", &Route{Backend: route})
+	return &TCPDialer{
+		Port:               443,
+		Allowed:            NewCIDRSet(mustParseCIDRs(t, "192.0.2.0/24")),
+		Timeout:            5 * time.Second,
+		Routes:             routes,
+		HTTPConnectProxy:   proxy.listener.Addr().String(),
+		HTTPConnectHeaders: []string{"Proxy-Authorization: Basic c25pZDpzZWNyZXQ="},
+	}
+}
+
+var httpConnectClient = fakeClientConn{
+	localAddr:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+	remoteAddr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 51234},
+}
+
+func TestHTTPConnect(t *testing.T) {
+	proxy := newFakeConnectProxy(t, "200 Connection established")
+	backend := proxy.dialer(t, "192.0.2.10")
+
+	// The proxy itself is not within Allowed: only the target is checked
+	conn, err := backend.Dial("example.com", nil, httpConnectClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := <-proxy.requests
+	if request.Method != http.MethodConnect || request.RequestURI != "192.0.2.10:443" || request.Host != "192.0.2.10:443" {
+		t.Errorf("proxy received %s %s with Host %s, want CONNECT 192.0.2.10:443", request.Method, request.RequestURI, request.Host)
+	}
+	if auth := request.Header.Get("Proxy-Authorization"); auth != "Basic c25pZDpzZWNyZXQ=" {
+		t.Errorf("proxy received Proxy-Authorization %q", auth)
+	}
+
+	if _, err := io.WriteString(conn, "ClientHello"); err != nil {
+		t.Fatal(err)
+	}
+	echoed := make([]byte, len("ClientHello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+	if string(echoed) != "ClientHello" {
+		t.Errorf("tunnel echoed %q", echoed)
+	}
+}
+
+func TestHTTPConnectDisallowedTarget(t *testing.T) {
+	proxy := newFakeConnectProxy(t, "200 Connection established")
+	backend := proxy.dialer(t, "198.51.100.10")
+
+	conn, err := backend.Dial("example.com", nil, httpConnectClient)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialing a disallowed target through the proxy succeeded")
+	}
+	if !errors.Is(err, errDisallowedBackend) {
+		t.Errorf("got %v, want errDisallowedBackend", err)
+	}
+	if address := dialedAddress(err); address != "198.51.100.10:443" {
+		t.Errorf("error is reported against %q, want the target 198.51.100.10:443", address)
+	}
+	select {
+	case request := <-proxy.requests:
+		t.Errorf("proxy received %s %s for a disallowed target", request.Method, request.RequestURI)
+	default:
+	}
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	proxy := newFakeConnectProxy(t, "407 Proxy Authentication Required")
+	backend := proxy.dialer(t, "192.0.2.10:8443")
+
+	conn, err := backend.Dial("example.com", nil, httpConnectClient)
+	if err == nil {
+		conn.Close()
+		t.Fatal("dialing succeeded even though the proxy refused")
+	}
+	if !errors.Is(err, errHTTPConnect) {
+		t.Errorf("got %v, want errHTTPConnect", err)
+	}
+	if request := <-proxy.requests; request.RequestURI != "192.0.2.10:8443" {
+		t.Errorf("proxy received CONNECT %s, want 192.0.2.10:8443", request.RequestURI)
+	}
+}
+
+func TestHTTPConnectUnresponsiveProxy(t *testing.T) {
+	defer func(timeout time.Duration) { httpConnectTimeout = timeout }(httpConnectTimeout)
+	httpConnectTimeout = 100 * time.Millisecond
+
+	proxy := newFakeConnectProxy(t, "")
+	backend := proxy.dialer(t, "192.0.2.10")
+	// Without a dial timeout, only httpConnectTimeout ends the handshake
+	backend.Timeout = 0
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := backend.Dial("example.com", nil, httpConnectClient)
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, errHTTPConnect) || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got %v, want an HTTP CONNECT timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dialing through a proxy which never responds didn't time out")
+	}
+	<-proxy.requests
+}
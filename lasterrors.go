@@ -0,0 +1,88 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// LastErrors records the most recent error for each of up to Size
+// backends, forgetting the least recently failed backend when full
+type LastErrors struct {
+	Size int
+
+	mu      sync.Mutex
+	order   *list.List // of *backendLastError, most recent first
+	entries map[string]*list.Element
+}
+
+type backendLastError struct {
+	Backend string
+	Time    time.Time
+	Error   string
+}
+
+// Record records err as the most recent error for backend.  It does
+// nothing if last is nil.
+func (last *LastErrors) Record(backend string, err error) {
+	if last == nil {
+		return
+	}
+	entry := &backendLastError{Backend: backend, Time: time.Now(), Error: err.Error()}
+	last.mu.Lock()
+	defer last.mu.Unlock()
+	if last.entries == nil {
+		last.order = list.New()
+		last.entries = make(map[string]*list.Element, last.Size)
+	}
+	if elem, ok := last.entries[backend]; ok {
+		elem.Value = entry
+		last.order.MoveToFront(elem)
+		return
+	}
+	if last.order.Len() >= last.Size {
+		oldest := last.order.Back()
+		last.order.Remove(oldest)
+		delete(last.entries, oldest.Value.(*backendLastError).Backend)
+	}
+	last.entries[backend] = last.order.PushFront(entry)
+}
+
+// Snapshot returns the recorded errors, most recent first
+func (last *LastErrors) Snapshot() []backendLastError {
+	last.mu.Lock()
+	defer last.mu.Unlock()
+	if last.order == nil {
+		return nil
+	}
+	entries := make([]backendLastError, 0, last.order.Len())
+	for elem := last.order.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, *elem.Value.(*backendLastError))
+	}
+	return entries
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"log"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxLatencySamples bounds the number of dial latencies kept per backend
+// per interval; beyond this, a uniform random sample is kept
+const maxLatencySamples = 1024
+
+type latencySamples struct {
+	samples []time.Duration
+	count   int
+}
+
+// DialLatencyReporter periodically logs percentiles of backend dial
+// latency, for operators without a metrics stack
+type DialLatencyReporter struct {
+	Interval time.Duration
+
+	mu       sync.Mutex
+	backends map[string]*latencySamples
+}
+
+// Observe records the latency of a successful dial to backend.  It does
+// nothing if reporter is nil.
+func (reporter *DialLatencyReporter) Observe(backend string, latency time.Duration) {
+	if reporter == nil {
+		return
+	}
+	reporter.mu.Lock()
+	defer reporter.mu.Unlock()
+	if reporter.backends == nil {
+		reporter.backends = make(map[string]*latencySamples)
+	}
+	s, ok := reporter.backends[backend]
+	if !ok {
+		s = new(latencySamples)
+		reporter.backends[backend] = s
+	}
+	s.count++
+	if len(s.samples) < maxLatencySamples {
+		s.samples = append(s.samples, latency)
+	} else if i := rand.IntN(s.count); i < maxLatencySamples {
+		s.samples[i] = latency
+	}
+}
+
+func (reporter *DialLatencyReporter) Run() {
+	ticker := time.NewTicker(reporter.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		reporter.report()
+	}
+}
+
+func (reporter *DialLatencyReporter) report() {
+	reporter.mu.Lock()
+	backends := reporter.backends
+	reporter.backends = nil
+	reporter.mu.Unlock()
+
+	for _, name := range slices.Sorted(maps.Keys(backends)) {
+		s := backends[name]
+		slices.Sort(s.samples)
+		log.Printf("Backend dial latency for %s over the last %s: %d dials, p50 %s, p95 %s, p99 %s",
+			name, reporter.Interval, s.count, percentile(s.samples, 0.50), percentile(s.samples, 0.95), percentile(s.samples, 0.99))
+	}
+}
+
+// percentile returns the pth percentile of sorted, which must not be empty
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(p*float64(len(sorted)-1)+0.5)]
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errInvalidLifetimeHint = errors.New("ClientHello contains an invalid lifetime hint")
+
+var errLifetimeExceeded = errors.New("connection exceeded its maximum lifetime")
+
+// parseLifetimeHint parses the data of a -lifetime-extension extension,
+// which must be a non-zero number of seconds as a 32-bit big-endian integer
+func parseLifetimeHint(data []byte) (time.Duration, error) {
+	if len(data) != 4 {
+		return 0, fmt.Errorf("%w: extension is %d bytes long instead of 4", errInvalidLifetimeHint, len(data))
+	}
+	seconds := binary.BigEndian.Uint32(data)
+	if seconds == 0 {
+		return 0, fmt.Errorf("%w: lifetime is zero", errInvalidLifetimeHint)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// maxLifetime returns the maximum lifetime of a connection whose
+// ClientHello is contained in helloBytes: the hint in the
+// LifetimeExtension extension, capped at LifetimeExtensionCap, or
+// MaxLifetime if the extension is absent.  Zero means no maximum.
+func (server *Server) maxLifetime(helloBytes []byte) (time.Duration, error) {
+	if server.LifetimeExtension == 0 {
+		return server.MaxLifetime, nil
+	}
+	data, ok := clientHelloExtension(helloBytes, int(server.LifetimeExtension))
+	if !ok {
+		return server.MaxLifetime, nil
+	}
+	lifetime, err := parseLifetimeHint(data)
+	if err != nil {
+		return 0, err
+	}
+	return min(lifetime, server.LifetimeExtensionCap), nil
+}
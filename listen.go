@@ -0,0 +1,210 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"src.agwa.name/go-listener"
+)
+
+// readListenFile reads newline-separated listener specs from the file at
+// path, or from stdin if path is "-".  Blank lines and lines starting
+// with # are ignored.
+func readListenFile(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+	var specs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		specs = append(specs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return specs, nil
+}
+
+func listenReusePort(address string) (net.Listener, error) {
+	config := net.ListenConfig{
+		Control: func(network string, address string, c syscall.RawConn) error {
+			var controlErr error
+			if err := c.Control(func(fd uintptr) {
+				controlErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return controlErr
+		},
+	}
+	return config.Listen(context.Background(), "tcp", address)
+}
+
+// openReusePort is like listener.Open, except that tcp: listeners are opened with SO_REUSEPORT set
+func openReusePort(spec string) (net.Listener, error) {
+	address, isTCP := strings.CutPrefix(spec, "tcp:")
+	if !isTCP {
+		return listener.Open(spec)
+	}
+	if !strings.Contains(address, ":") {
+		// Just a port number, so listen on all interfaces
+		address = ":" + address
+	}
+	return listenReusePort(address)
+}
+
+func openAllReusePort(specs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(specs))
+	for _, spec := range specs {
+		l, err := openReusePort(spec)
+		if err != nil {
+			listener.CloseAll(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenSpecSchemes are the listener types which could be mistaken for
+// the HOST of a HOST:PORT address, such as fd:3
+var listenSpecSchemes = []string{"tcp", "unix", "fd", "proxy", "tls"}
+
+// metricsListenSpec converts a -metrics-addr of the form HOST:PORT, such
+// as localhost:9100 or metrics-host:9100, into a tcp: listener spec.
+// Other addresses are assumed to be listener specs already, such as
+// unix:/run/snid-metrics.sock.
+func metricsListenSpec(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return address
+	}
+	if slices.Contains(listenSpecSchemes, host) {
+		return address
+	}
+	return "tcp:" + address
+}
+
+// normalizeListenSpec returns a form of spec in which equivalent tcp:
+// listener specs, such as tcp:443 and tcp::443, are equal
+func normalizeListenSpec(spec string) string {
+	address, isTCP := strings.CutPrefix(spec, "tcp:")
+	if !isTCP {
+		return spec
+	}
+	if !strings.Contains(address, ":") {
+		address = ":" + address
+	}
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			host = ip.String()
+		}
+		address = net.JoinHostPort(strings.ToLower(host), port)
+	}
+	return "tcp:" + address
+}
+
+// checkListenSpecs returns an error if there are more than max specs
+// (unless max is 0), or if two specs are equivalent
+func checkListenSpecs(specs []string, max int) error {
+	if max != 0 && len(specs) > max {
+		return fmt.Errorf("%d listeners specified, but -max-listeners is %d", len(specs), max)
+	}
+	seen := make(map[string]string)
+	for _, spec := range specs {
+		normalized := normalizeListenSpec(spec)
+		if other, ok := seen[normalized]; ok {
+			return fmt.Errorf("-listen %s duplicates -listen %s", spec, other)
+		}
+		seen[normalized] = spec
+	}
+	return nil
+}
+
+// modes are the values accepted by -mode and -listener-mode
+var modes = []string{"unix", "tcp", "nat46", "nat64", "spray"}
+
+// listenerModes returns the mode to use for each of specs: the mode
+// given for it in overrides (keyed by normalized spec), or defaultMode
+func listenerModes(specs []string, defaultMode string, overrides map[string]string) ([]string, error) {
+	result := make([]string, len(specs))
+	used := make(map[string]bool)
+	for i, spec := range specs {
+		normalized := normalizeListenSpec(spec)
+		if mode, ok := overrides[normalized]; ok {
+			result[i] = mode
+			used[normalized] = true
+		} else if defaultMode != "" {
+			result[i] = defaultMode
+		} else {
+			return nil, fmt.Errorf("-listen %s has no mode; specify -mode or -listener-mode", spec)
+		}
+	}
+	for spec := range overrides {
+		if !used[spec] {
+			return nil, fmt.Errorf("-listener-mode %s does not match any -listen", spec)
+		}
+	}
+	return result, nil
+}
+
+// checkListenerAddrs returns an error if two of the opened listeners
+// have the same address, which can happen with -reuseport
+func checkListenerAddrs(specs []string, listeners []net.Listener) error {
+	seen := make(map[string]string)
+	for i, l := range listeners {
+		addr := l.Addr().Network() + ":" + l.Addr().String()
+		if other, ok := seen[addr]; ok {
+			return fmt.Errorf("-listen %s and -listen %s both listen on %s", specs[i], other, l.Addr())
+		}
+		seen[addr] = specs[i]
+	}
+	return nil
+}
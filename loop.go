@@ -0,0 +1,105 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"log"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// listenerAddrs identifies snid's own TCP listeners, so that a backend
+// address which would loop back to snid can be detected
+type listenerAddrs struct {
+	addrs    []netip.AddrPort
+	localIPs map[netip.Addr]bool // addresses of local interfaces
+}
+
+// SetListeners tells backend the addresses of snid's listeners, so that
+// it refuses to dial them
+func (backend *TCPDialer) SetListeners(listeners []net.Listener) {
+	addrs := &listenerAddrs{localIPs: make(map[netip.Addr]bool)}
+	for _, l := range listeners {
+		if tcpAddr, ok := l.Addr().(*net.TCPAddr); ok {
+			addrs.addrs = append(addrs.addrs, tcpAddr.AddrPort())
+		}
+	}
+	if interfaceAddrs, err := net.InterfaceAddrs(); err != nil {
+		log.Printf("Unable to list local addresses for loop detection: %s", err)
+	} else {
+		for _, addr := range interfaceAddrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				if ip, ok := netip.AddrFromSlice(ipnet.IP); ok {
+					addrs.localIPs[ip.Unmap()] = true
+				}
+			}
+		}
+	}
+	backend.listeners.Store(addrs)
+}
+
+// isListener reports whether connecting to ip and port would connect to
+// one of snid's own listeners
+func (addrs *listenerAddrs) isListener(ip netip.Addr, port int) bool {
+	if addrs == nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, addr := range addrs.addrs {
+		if int(addr.Port()) != port {
+			continue
+		}
+		listenIP := addr.Addr().Unmap()
+		if listenIP == ip {
+			return true
+		}
+		// A wildcard IPv6 listener also accepts IPv4 connections
+		if listenIP.IsUnspecified() && (listenIP.Is6() || ip.Is4()) && (ip.IsLoopback() || addrs.localIPs[ip]) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnLoopingRoutes logs a warning for each route (including the
+// catch-all backend) which points back at one of snid's own listeners.
+// Such routes were loaded before the listeners were opened, so they
+// weren't rejected, but connections to them fail.
+func (backend *TCPDialer) warnLoopingRoutes() {
+	routes := backend.Routes.All()
+	for _, hostname := range slices.Sorted(maps.Keys(routes)) {
+		if err := backend.checkRoute(hostname, routes[hostname]); err != nil {
+			log.Printf("Warning: route for %s is unusable: %s", hostname, err)
+		}
+	}
+	if backend.CatchAll != "" {
+		if err := backend.checkRoute("", &Route{Backend: backend.CatchAll}); err != nil {
+			log.Printf("Warning: -catch-all-backend is unusable: %s", err)
+		}
+	}
+}
@@ -26,13 +26,20 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -41,33 +48,230 @@ import (
 	"src.agwa.name/go-listener"
 )
 
-var (
-	stopping = false
-)
-
 func main() {
 	var flags struct {
-		listen          []string
-		defaultHostname string
-		mode            string
-		timeout         time.Duration
-		proxyProto      bool
-		unixDirectory   string
-		backendCidr     []*net.IPNet
-		backendPort     int
-		nat46Prefix     net.IP
-		addRoute        bool
+		listen           []string
+		listenFile       string
+		listenerModes    map[string]string
+		defaultHostname  string
+		ipLiteralSNI     string
+		mode             string
+		timeout          time.Duration
+		proxyProto       bool
+		unixDirectory    string
+		backendCidr      []*net.IPNet
+		hostnameCidr     map[string][]*net.IPNet
+		excludeCidr      []*net.IPNet
+		backendPort      int
+		nat46Prefix      net.IP
+		nat64Prefix      *net.IPNet
+		addRoute         bool
+		reusePort        bool
+		metricsAddr      string
+		metricsBackend   string
+		otlpEndpoint     string
+		otlpInterval     time.Duration
+		otlpTraces       string
+		maxFDs           uint64
+		routeDir         string
+		closeWriteDelay  time.Duration
+		noHalfClose      bool
+		noDelay          bool
+		idleTimeout      time.Duration
+		maxLifetime      time.Duration
+		lifetimeExt      uint
+		lifetimeExtCap   time.Duration
+		rejectLogRate    float64
+		logConnections   string
+		requireFQDN      bool
+		allowSingleLabel bool
+		allowSNISuffix   []string
+		denySNISuffix    []string
+		ptrSuffix        []string
+		eventWebhook     string
+		webhookEvents    string
+		backendFwmark    int
+		userTimeout      time.Duration
+		probeHostname    string
+		startupDelay     time.Duration
+		proxyProbe       string
+		srvService       string
+		httpConnect      string
+		httpConnectHdrs  []string
+		srvProto         string
+		firstByteTimeout time.Duration
+		headerTimeout    time.Duration
+		tarpitDuration   time.Duration
+		allDown          string
+		resetOnError     map[string]bool
+		allDownRetry     time.Duration
+		tarpitMax        int64
+		pskRoutePrefix   string
+		dumpFailedHello  bool
+		unixShard        bool
+		unixFullClose    bool
+		backendResolver  string
+		checkResolver    bool
+		traceSampleRate  float64
+		acceptProxyProto bool
+		trustedProxyCidr []*net.IPNet
+		proxyTLVs        []byte
+		maxClientConns   int
+		pushURL          string
+		pushJob          string
+		pushGrouping     map[string]string
+		pushInterval     time.Duration
+		maxBytes         uint64
+		maxBytesMode     string
+		statsLogInterval time.Duration
+		statsSocket      string
+		normalizeIDN     bool
+		rejectBogusHello bool
+		minTLSVersion    string
+		sprayBackends    []SprayBackend
+		logFlows         bool
+		requireALPN      bool
+		routeFile        string
+		catchAllBackend  string
+		maxListeners     int
+		observeOnly      bool
+		exemplars        bool
+		maxLookups       int
+		proxyVersions    map[string]string
+		maxHandlers      int
+		peekBudget       int64
+		lenientSNIPort   bool
+		preambles        map[string][]byte
+		topHostnames     int
+		lastErrors       int
+		auditLog         string
+		auditLogMaxSize  int64
+		auditLogFiles    int
+		geoIPDB          string
+		drainFile        string
 	}
 	flag.Func("listen", "Socket to listen on (repeatable)", func(arg string) error {
 		flags.listen = append(flags.listen, arg)
 		return nil
 	})
+	flag.IntVar(&flags.maxLookups, "max-dns-lookups", 0, "Maximum number of backend DNS lookups in flight at once; others wait for up to -timeout (tcp, nat46, nat64 modes) (0 means unlimited)")
+	flag.StringVar(&flags.listenFile, "listen-file", "", "File of newline-separated sockets to listen on, in addition to -listen (- means stdin)")
+	flag.IntVar(&flags.maxListeners, "max-listeners", 0, "Refuse to start if more than this many -listen flags are specified (0 means unlimited)")
 	flag.StringVar(&flags.defaultHostname, "default-hostname", "", "Default hostname if client does not provide SNI")
-	flag.StringVar(&flags.mode, "mode", "", "unix, tcp, or nat46")
+	flag.StringVar(&flags.ipLiteralSNI, "ip-literal-sni-hostname", "", "Hostname to use if client provides an IP address as SNI (by default, such connections are rejected)")
+	flag.BoolVar(&flags.normalizeIDN, "normalize-idn", false, "Convert internationalized SNI hostnames to ASCII (punycode) form, and reject invalid ones")
+	flag.Func("min-tls-version", "Reject ClientHellos which don't offer at least this TLS version: 1.0, 1.1, 1.2, or 1.3", func(arg string) error {
+		if _, ok := tlsVersions[arg]; !ok {
+			return fmt.Errorf("unknown TLS version %q", arg)
+		}
+		flags.minTLSVersion = arg
+		return nil
+	})
+	flag.BoolVar(&flags.rejectBogusHello, "reject-bogus-hello", false, "Reject ClientHellos which offer no cipher suites (other than GREASE values)")
+	flag.BoolVar(&flags.requireFQDN, "require-fqdn", false, "Reject SNI hostnames which aren't valid fully-qualified DNS hostnames")
+	flag.Func("allow-sni-suffix", "Only allow SNI hostnames matching this domain suffix, e.g. example.com or .example.com for subdomains only (repeatable)", func(arg string) error {
+		flags.allowSNISuffix = append(flags.allowSNISuffix, arg)
+		return nil
+	})
+	flag.Func("deny-sni-suffix", "Reject SNI hostnames matching this domain suffix, e.g. example.com or .example.com for subdomains only (repeatable)", func(arg string) error {
+		flags.denySNISuffix = append(flags.denySNISuffix, arg)
+		return nil
+	})
+	flag.BoolVar(&flags.allowSingleLabel, "allow-single-label-sni", false, "With -require-fqdn, allow SNI hostnames with only one label (e.g. for unix mode)")
+	flag.BoolVar(&flags.requireALPN, "require-alpn", false, "Reject clients which don't offer any ALPN protocols")
+	flag.BoolVar(&flags.lenientSNIPort, "lenient-sni-port", false, "If the SNI hostname has a :port suffix, route using the hostname and connect to that port on the backend")
+	flag.BoolVar(&flags.observeOnly, "observe-only", false, "Don't proxy connections; just log the backend each would be routed to, and close it")
+	flag.StringVar(&flags.mode, "mode", "", "unix, tcp, nat46, nat64, or spray")
+	flag.Func("listener-mode", "LISTENER=MODE: use MODE instead of -mode for connections accepted by the -listen LISTENER (repeatable)", func(arg string) error {
+		spec, mode, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("must be of the form LISTENER=MODE")
+		}
+		if !slices.Contains(modes, mode) {
+			return fmt.Errorf("mode must be unix, tcp, nat46, nat64, or spray")
+		}
+		if flags.listenerModes == nil {
+			flags.listenerModes = make(map[string]string)
+		}
+		flags.listenerModes[normalizeListenSpec(spec)] = mode
+		return nil
+	})
+	flag.Func("spray-backends", "ADDRESS@WEIGHT,...: backends to spray connections across, regardless of SNI (spray mode, for load testing)", func(arg string) error {
+		backends, err := parseSprayBackends(arg)
+		if err != nil {
+			return err
+		}
+		flags.sprayBackends = append(flags.sprayBackends, backends...)
+		return nil
+	})
 	flag.DurationVar(&flags.timeout, "timeout", 0, "Timeout when dialling the backend")
+	flag.DurationVar(&flags.idleTimeout, "idle-timeout", 0, "Close connections which transfer no data in either direction for this long (0 means never)")
+	flag.DurationVar(&flags.maxLifetime, "max-lifetime", 0, "Close connections this long after the backend is connected (0 means never)")
+	flag.UintVar(&flags.lifetimeExt, "lifetime-extension", 0, "Type of ClientHello extension containing a connection's maximum lifetime in seconds, overriding -max-lifetime (requires -lifetime-extension-cap)")
+	flag.DurationVar(&flags.lifetimeExtCap, "lifetime-extension-cap", 0, "Maximum lifetime which -lifetime-extension can request")
+	flag.DurationVar(&flags.firstByteTimeout, "first-byte-timeout", 0, "Timeout for receiving the first byte from the client (defaults to -header-timeout)")
+	flag.DurationVar(&flags.headerTimeout, "header-timeout", defaultHeaderTimeout, "Timeout for receiving the complete ClientHello from the client")
 	flag.BoolVar(&flags.proxyProto, "proxy-proto", false, "Use PROXY protocol when talking to backend (tcp, unix modes)")
+	flag.BoolVar(&flags.acceptProxyProto, "accept-proxy-proto", false, "Require clients to send a PROXY protocol v2 header, and use the client address from it")
+	flag.Func("proxy-proto-trusted-cidr", "With -accept-proxy-proto, only read PROXY headers from clients within this CIDR (repeatable)", func(arg string) error {
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return err
+		}
+		flags.trustedProxyCidr = append(flags.trustedProxyCidr, ipnet)
+		return nil
+	})
+	flag.Func("proxy-tlv", "Type of PROXY protocol TLV (name or number) to pass from the client's PROXY header to the backend (repeatable)", func(arg string) error {
+		tlvType, err := parseProxyTLVType(arg)
+		if err != nil {
+			return err
+		}
+		flags.proxyTLVs = append(flags.proxyTLVs, tlvType)
+		return nil
+	})
+	flag.Func("backend-proxy-proto", "HOSTNAME=none|v1|v2: PROXY protocol version to use for HOSTNAME's backend instead of v2 (repeatable) (requires -proxy-proto)", func(arg string) error {
+		origHostname, arg, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("must be of the form HOSTNAME=VERSION")
+		}
+		hostname, err := canonicalizeHostname(origHostname)
+		if err != nil {
+			return err
+		}
+		version, err := parseProxyVersion(arg)
+		if err != nil {
+			return err
+		}
+		if flags.proxyVersions == nil {
+			flags.proxyVersions = make(map[string]string)
+		}
+		flags.proxyVersions[hostname] = version
+		return nil
+	})
+	flag.Func("backend-preamble", "HOSTNAME=HEX or HOSTNAME=@FILE: bytes to send to HOSTNAME's backend before the PROXY header and ClientHello (repeatable)", func(arg string) error {
+		origHostname, arg, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("must be of the form HOSTNAME=HEX or HOSTNAME=@FILE")
+		}
+		hostname, err := canonicalizeHostname(origHostname)
+		if err != nil {
+			return err
+		}
+		preamble, err := parsePreamble(arg)
+		if err != nil {
+			return err
+		}
+		if flags.preambles == nil {
+			flags.preambles = make(map[string][]byte)
+		}
+		flags.preambles[hostname] = preamble
+		return nil
+	})
+	flag.StringVar(&flags.catchAllBackend, "catch-all-backend", "", "Backend for SNI hostnames which have no backend of their own: a socket name (unix mode) or an address (tcp, nat46, nat64 modes)")
 	flag.StringVar(&flags.unixDirectory, "unix-directory", "", "Path to directory containing backend UNIX sockets (unix mode)")
-	flag.Func("backend-cidr", "CIDR of allowed backends (repeatable) (tcp, nat46 modes)", func(arg string) error {
+	flag.BoolVar(&flags.unixFullClose, "unix-full-close", false, "Close the backend UNIX socket connection entirely, instead of half-closing it, when the client finishes sending (unix mode)")
+	flag.BoolVar(&flags.unixShard, "unix-shard", false, "Look for backend UNIX sockets in subdirectories of -unix-directory named by hostname hash (unix mode)")
+	flag.Func("backend-cidr", "CIDR of allowed backends (repeatable) (tcp, nat46, nat64 modes)", func(arg string) error {
 		_, ipnet, err := net.ParseCIDR(arg)
 		if err != nil {
 			return err
@@ -75,113 +279,990 @@ func main() {
 		flags.backendCidr = append(flags.backendCidr, ipnet)
 		return nil
 	})
+	flag.Func("backend-exclude-cidr", "CIDR of disallowed backends, overriding -backend-cidr (repeatable) (tcp, nat46, nat64 modes)", func(arg string) error {
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return err
+		}
+		flags.excludeCidr = append(flags.excludeCidr, ipnet)
+		return nil
+	})
+	flag.Func("hostname-cidr", "HOSTNAME=CIDR: only allow HOSTNAME's backend to be within CIDR (repeatable) (tcp, nat46, nat64 modes)", func(arg string) error {
+		origHostname, cidr, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("must be of the form HOSTNAME=CIDR")
+		}
+		hostname, err := canonicalizeHostname(origHostname)
+		if err != nil {
+			return err
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		if flags.hostnameCidr == nil {
+			flags.hostnameCidr = make(map[string][]*net.IPNet)
+		}
+		flags.hostnameCidr[hostname] = append(flags.hostnameCidr[hostname], ipnet)
+		return nil
+	})
 	flag.IntVar(&flags.backendPort, "backend-port", 0, "Port number of backend (defaults to same port number as listener) (tcp mode)")
-	flag.Func("nat46-prefix", "IPv6 prefix for NAT46 source address (nat46 mode)", func(arg string) error {
-		flags.nat46Prefix = net.ParseIP(arg)
-		if flags.nat46Prefix == nil {
-			return fmt.Errorf("not a valid IP address")
+	flag.Func("nat46-prefix", "IPv6 /96 prefix for NAT46 source address (nat46 mode)", func(arg string) error {
+		prefix, err := parseNAT46Prefix(arg)
+		if err != nil {
+			return err
+		}
+		flags.nat46Prefix = prefix
+		return nil
+	})
+	flag.Func("nat64-prefix", "IPv4 CIDR for NAT64 source address (nat64 mode)", func(arg string) error {
+		_, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return err
+		}
+		if ipnet.IP.To4() == nil {
+			return fmt.Errorf("not an IPv4 CIDR")
 		}
-		if flags.nat46Prefix.To4() != nil {
-			return fmt.Errorf("not an IPv6 address")
+		flags.nat64Prefix = ipnet
+		return nil
+	})
+	flag.BoolVar(&flags.addRoute, "add-local-route", false, "Insert route for nat46-prefix or nat64-prefix into the local routing table (nat46, nat64 modes)")
+	flag.StringVar(&flags.metricsAddr, "metrics-addr", "", "Address or listener spec on which to serve HTTP endpoints for Prometheus metrics and readiness (e.g. localhost:9100 or unix:/run/snid-metrics.sock)")
+	flag.StringVar(&flags.metricsBackend, "metrics-backend", "prometheus", "prometheus (metrics are only scraped from -metrics-addr) or otlp (metrics are also pushed to -otlp-endpoint)")
+	flag.StringVar(&flags.otlpEndpoint, "otlp-endpoint", "", "URL of OTLP/HTTP metrics endpoint (e.g. http://localhost:4318/v1/metrics) (otlp metrics backend)")
+	flag.DurationVar(&flags.otlpInterval, "otlp-interval", time.Minute, "Interval between pushes to -otlp-endpoint (otlp metrics backend)")
+	flag.StringVar(&flags.otlpTraces, "otlp-traces-endpoint", "", "URL of OTLP/HTTP traces endpoint to export a span for every connection to (e.g. http://localhost:4318/v1/traces)")
+	flag.StringVar(&flags.pushURL, "metrics-push-url", "", "URL of Prometheus pushgateway to periodically push metrics to (e.g. http://localhost:9091)")
+	flag.StringVar(&flags.pushJob, "metrics-push-job", "snid", "Job label to use when pushing to -metrics-push-url")
+	flag.Func("metrics-push-grouping", "NAME=VALUE: grouping label to use when pushing to -metrics-push-url, e.g. instance=HOSTNAME (repeatable)", func(arg string) error {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return fmt.Errorf("must be of the form NAME=VALUE")
+		}
+		if flags.pushGrouping == nil {
+			flags.pushGrouping = make(map[string]string)
 		}
+		flags.pushGrouping[name] = value
+		return nil
+	})
+	flag.BoolVar(&flags.exemplars, "metrics-exemplars", false, "Attach the connection's trace ID as an exemplar to backend dial duration observations (requires -otlp-traces-endpoint)")
+	flag.DurationVar(&flags.pushInterval, "metrics-push-interval", time.Minute, "Interval between pushes to -metrics-push-url")
+	flag.BoolVar(&flags.reusePort, "reuseport", false, "Set SO_REUSEPORT on TCP listeners so multiple processes can listen on the same address")
+	flag.DurationVar(&flags.userTimeout, "backend-user-timeout", 0, "TCP_USER_TIMEOUT to set on backend connections (tcp, nat46, nat64 modes) (Linux only)")
+	flag.IntVar(&flags.backendFwmark, "backend-fwmark", 0, "Firewall mark (SO_MARK) to set on backend connections (tcp, nat46, nat64 modes) (Linux only)")
+	flag.Func("backend-ptr-suffix", "Only connect to backend addresses with a PTR record matching this domain suffix, e.g. .svc.cluster.local (repeatable) (tcp, nat46, nat64, spray modes)", func(arg string) error {
+		flags.ptrSuffix = append(flags.ptrSuffix, arg)
 		return nil
 	})
-	flag.BoolVar(&flags.addRoute, "add-local-route", false, "Insert route for nat46-prefix into the local routing table (nat46 mode)")
+	flag.StringVar(&flags.httpConnect, "backend-http-connect", "", "HOST:PORT of an HTTP CONNECT proxy to dial backends through (tcp, nat46, nat64, spray modes)")
+	flag.Func("backend-http-connect-header", "NAME: VALUE header to send to the -backend-http-connect proxy, e.g. for Proxy-Authorization (repeatable)", func(arg string) error {
+		name, _, ok := strings.Cut(arg, ":")
+		if !ok || strings.TrimSpace(name) == "" || strings.ContainsAny(arg, "\r\n") {
+			return fmt.Errorf("must be of the form NAME: VALUE")
+		}
+		flags.httpConnectHdrs = append(flags.httpConnectHdrs, arg)
+		return nil
+	})
+	flag.StringVar(&flags.srvService, "srv-service", "", "Find backends by looking up SRV records for this service (e.g. https) (tcp, nat46, nat64 modes)")
+	flag.StringVar(&flags.srvProto, "srv-proto", "tcp", "Protocol to use in SRV lookups for -srv-service (tcp, nat46, nat64 modes)")
+	flag.Func("backend-resolver", "IP:PORT of DNS server to use for looking up backends instead of the system resolver (tcp, nat46, nat64 modes)", func(arg string) error {
+		host, _, err := net.SplitHostPort(arg)
+		if err != nil {
+			return err
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("%q is not an IP address", host)
+		}
+		flags.backendResolver = arg
+		return nil
+	})
+	flag.BoolVar(&flags.checkResolver, "check-backend-resolver", false, "At startup, exit if the -backend-resolver DNS server does not respond (tcp, nat46, nat64 modes)")
+	flag.StringVar(&flags.routeDir, "route-dir", "", "Path to directory of files mapping hostnames to backend addresses, reloaded on change (tcp, nat46, nat64 modes)")
+	flag.StringVar(&flags.routeFile, "route-file", "", "Path to file mapping hostnames to backend addresses, one per line, reloaded on SIGHUP (tcp, nat46, nat64 modes)")
+	flag.DurationVar(&flags.closeWriteDelay, "close-write-delay", 0, "Delay before half-closing the backend connection after the client finishes sending")
+	flag.BoolVar(&flags.noDelay, "nodelay", true, "Set TCP_NODELAY on client and backend connections; use -nodelay=false to batch small writes")
+	flag.BoolVar(&flags.noHalfClose, "no-half-close", false, "Never half-close the backend connection; wait for the backend to close it instead")
+	flag.StringVar(&flags.eventWebhook, "event-webhook", "", "URL to POST connection events to as JSON")
+	flag.StringVar(&flags.webhookEvents, "event-webhook-types", EventDenied+","+EventNoSNI, "Comma-separated list of event types to POST to -event-webhook (accepted, denied, no-sni)")
+	flag.StringVar(&flags.probeHostname, "startup-probe-hostname", "", "Hostname to dial through the backend at startup; /readyz fails until this succeeds")
+	flag.DurationVar(&flags.startupDelay, "startup-delay", 0, "Close connections as soon as they're accepted, and fail /readyz, for this long after starting or until -startup-probe-hostname succeeds")
+	flag.StringVar(&flags.proxyProbe, "proxy-proto-probe-backend", "", "Hostname whose backend is periodically sent a PROXY header to check that it accepts it; /readyz fails while it doesn't (requires -proxy-proto)")
+	flag.Func("error-close", "ERROR=reset|fin: how to close client connections which fail with ERROR (an error label, or default for the rest) (repeatable)", func(arg string) error {
+		label, behaviour, ok := strings.Cut(arg, "=")
+		if !ok || label == "" || (behaviour != "reset" && behaviour != "fin") {
+			return fmt.Errorf("must be of the form ERROR=reset or ERROR=fin")
+		}
+		if flags.resetOnError == nil {
+			flags.resetOnError = make(map[string]bool)
+		}
+		flags.resetOnError[label] = behaviour == "reset"
+		return nil
+	})
+	flag.StringVar(&flags.allDown, "all-down-behaviour", "close", "What to do with connections when every address of a backend fails to connect: close, tarpit (requires -tarpit-duration), or retry (tcp, nat46, nat64 modes)")
+	flag.DurationVar(&flags.allDownRetry, "all-down-retry-delay", time.Second, "How long to wait before trying the backend's addresses again with -all-down-behaviour retry")
+	flag.DurationVar(&flags.tarpitDuration, "tarpit-duration", 0, "Hold connections without SNI or to disallowed backends open for this long before closing them")
+	flag.Int64Var(&flags.tarpitMax, "tarpit-max", 1000, "Maximum number of connections to hold open at once with -tarpit-duration")
+	flags.logConnections = LogConnectionsErrors
+	flag.Func("log-connections", "Which connections to log when they close: all, errors, or none (default errors)", func(arg string) error {
+		policy, err := parseLogConnections(arg)
+		if err != nil {
+			return err
+		}
+		flags.logConnections = policy
+		return nil
+	})
+	flags.rejectLogRate = 1
+	flag.Func("reject-log-sample-rate", "Fraction of failed connections (greater than 0, up to 1) to log (default 1)", func(arg string) error {
+		rate, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return err
+		}
+		if rate <= 0 || rate > 1 {
+			return fmt.Errorf("must be greater than 0 and at most 1")
+		}
+		flags.rejectLogRate = rate
+		return nil
+	})
+	flag.StringVar(&flags.pskRoutePrefix, "psk-route-prefix", "", "Route connections whose first TLS PSK identity starts with this prefix to the hostname in the rest of the identity (advanced)")
+	flag.BoolVar(&flags.dumpFailedHello, "debug-dump-failed-hello", false, "Log a hex dump of ClientHellos which can't be parsed (for debugging; logs client data)")
+	flag.Func("trace-sample-rate", "Fraction of connections (between 0 and 1) for which to log the timing of each phase", func(arg string) error {
+		rate, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return err
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("must be between 0 and 1")
+		}
+		flags.traceSampleRate = rate
+		return nil
+	})
+	flag.StringVar(&flags.drainFile, "drain-file", "", "Stop accepting new connections while a file exists at this path")
+	flag.IntVar(&flags.maxHandlers, "max-handlers", 0, "Stop accepting connections while this many are being handled (0 means unlimited)")
+	flag.Int64Var(&flags.peekBudget, "peek-memory-budget", 0, "Reject connections while this many bytes in total are buffered by connections whose ClientHello is being read (0 means unlimited)")
+	flag.IntVar(&flags.maxClientConns, "max-conns-per-client", 0, "Maximum number of concurrent connections from each client IP address (0 means unlimited)")
+	flag.Uint64Var(&flags.maxBytes, "max-bytes-per-conn", 0, "Close connections which transfer more than this many bytes (0 means unlimited)")
+	flag.StringVar(&flags.maxBytesMode, "max-bytes-mode", "combined", "Whether -max-bytes-per-conn applies to both directions combined (combined) or to each direction (per-direction)")
+	flag.DurationVar(&flags.statsLogInterval, "stats-log-interval", 0, "Periodically log percentiles of backend dial latency over this interval")
+	flag.StringVar(&flags.statsSocket, "stats-socket", "", "Path of UNIX socket on which to serve stats commands (show info, show stat, show top, show errors, drain-backend, undrain-backend)")
+	flag.StringVar(&flags.auditLog, "audit-log", "", "Path of file to append a JSON record of every connection to")
+	flag.Int64Var(&flags.auditLogMaxSize, "audit-log-max-size", 100<<20, "Rotate -audit-log when it would exceed this many bytes (0 means never)")
+	flag.IntVar(&flags.auditLogFiles, "audit-log-max-files", 10, "Number of rotated -audit-log files to keep")
+	flag.StringVar(&flags.geoIPDB, "geoip-db", "", "Path of MaxMind GeoIP database (.mmdb) to look up the country of client addresses in, for metrics and logs")
+	flag.IntVar(&flags.lastErrors, "last-backend-errors", 0, "Number of routed backends whose most recent error to track for the stats socket's show errors command")
+	flag.IntVar(&flags.topHostnames, "top-hostnames", 0, "Number of most requested hostnames to track for the stats socket's show top command")
+	flag.BoolVar(&flags.logFlows, "log-flows", false, "Log the client and backend address pairs of each proxied connection")
+	flag.Uint64Var(&flags.maxFDs, "max-fds", 0, "Raise the open file descriptor limit to this value (as far as the hard limit allows)")
 	flag.Parse()
 
+	if flags.maxFDs != 0 {
+		limit, err := raiseFileLimit(flags.maxFDs)
+		if err != nil {
+			log.Fatalf("Failed to raise open file descriptor limit: %s", err)
+		}
+		if limit < flags.maxFDs {
+			log.Printf("Warning: open file descriptor limit is %d, which is less than -max-fds because the hard limit is too low", limit)
+		} else {
+			log.Printf("Open file descriptor limit is %d", limit)
+		}
+	}
+
+	if flags.lifetimeExt > math.MaxUint16 {
+		log.Fatal("-lifetime-extension must be between 1 and 65535")
+	}
+	if flags.lifetimeExt != 0 && flags.lifetimeExtCap <= 0 {
+		log.Fatal("-lifetime-extension requires -lifetime-extension-cap")
+	}
+	if len(flags.httpConnectHdrs) != 0 && flags.httpConnect == "" {
+		log.Fatal("-backend-http-connect-header requires -backend-http-connect")
+	}
+	if flags.exemplars && flags.otlpTraces == "" {
+		log.Fatal("-metrics-exemplars requires -otlp-traces-endpoint")
+	}
+	if flags.proxyProbe != "" && !flags.proxyProto {
+		log.Fatal("-proxy-proto-probe-backend requires -proxy-proto")
+	}
+	if len(flags.proxyVersions) != 0 && !flags.proxyProto {
+		for hostname, version := range flags.proxyVersions {
+			if version != "none" {
+				log.Fatalf("-backend-proxy-proto %s=%s conflicts with PROXY protocol being disabled; specify -proxy-proto to enable it", hostname, version)
+			}
+		}
+		log.Fatal("-backend-proxy-proto has no effect without -proxy-proto")
+	}
+	if len(flags.trustedProxyCidr) != 0 && !flags.acceptProxyProto {
+		log.Fatal("-proxy-proto-trusted-cidr requires -accept-proxy-proto")
+	}
+	if len(flags.proxyTLVs) != 0 && !(flags.acceptProxyProto && flags.proxyProto) {
+		log.Fatal("-proxy-tlv requires -accept-proxy-proto and -proxy-proto")
+	}
+
 	server := &Server{
 		ProxyProtocol:   flags.proxyProto,
 		DefaultHostname: flags.defaultHostname,
+		PSKRoutePrefix:  flags.pskRoutePrefix,
+		NormalizeIDN:    flags.normalizeIDN,
+		DumpFailedHello: flags.dumpFailedHello,
+		TraceSampleRate: flags.traceSampleRate,
+		Metrics:         NewMetrics(),
+
+		RejectBogusHello:     flags.rejectBogusHello,
+		MinTLSVersion:        tlsVersions[flags.minTLSVersion],
+		RejectLogSampleRate:  flags.rejectLogRate,
+		LogConnections:       flags.logConnections,
+		LogFlows:             flags.logFlows,
+		LenientSNIPort:       flags.lenientSNIPort,
+		RequireALPN:          flags.requireALPN,
+		RequireFQDN:          flags.requireFQDN,
+		AllowSingleLabelSNI:  flags.allowSingleLabel,
+		BackendProxyVersions: flags.proxyVersions,
+		BackendPreambles:     flags.preambles,
+		AcceptProxyProtocol:  flags.acceptProxyProto,
+		TrustedProxyCIDRs:    flags.trustedProxyCidr,
+		ProxyTLVs:            flags.proxyTLVs,
+		IPLiteralSNIHostname: flags.ipLiteralSNI,
+
+		FirstByteTimeout: flags.firstByteTimeout,
+		HeaderTimeout:    flags.headerTimeout,
+
+		CloseWriteDelay:  flags.closeWriteDelay,
+		DisableHalfClose: flags.noHalfClose,
+		UnixFullClose:    flags.unixFullClose,
+		DisableNoDelay:   !flags.noDelay,
+		IdleTimeout:      flags.idleTimeout,
+		MaxLifetime:      flags.maxLifetime,
+
+		LifetimeExtension:    uint16(flags.lifetimeExt),
+		LifetimeExtensionCap: flags.lifetimeExtCap,
+
+		MaxBytes:    flags.maxBytes,
+		MaxHandlers: flags.maxHandlers,
+	}
+	server.Metrics.Exemplars = flags.exemplars
+	if flags.peekBudget < 0 {
+		log.Fatal("-peek-memory-budget must not be negative")
+	} else if flags.peekBudget != 0 {
+		server.PeekBudget = &PeekBudget{Max: flags.peekBudget, Gauge: server.Metrics.peekMemory}
+	}
+
+	switch flags.maxBytesMode {
+	case "combined":
+	case "per-direction":
+		server.MaxBytesPerDirection = true
+	default:
+		log.Fatal("-max-bytes-mode must be combined or per-direction")
 	}
 
-	switch flags.mode {
-	case "unix":
-		if flags.unixDirectory == "" {
-			log.Fatal("-unix-directory must be specified when you use -mode unix")
+	if len(flags.allowSNISuffix) != 0 {
+		server.AllowedSNI = new(SuffixSet)
+		for _, suffix := range flags.allowSNISuffix {
+			server.AllowedSNI.Add(suffix)
 		}
-		server.Backend = &UnixDialer{Directory: flags.unixDirectory}
-	case "tcp":
-		if len(flags.backendCidr) == 0 {
-			log.Fatal("At least one -backend-cidr flag must be specified when you use -mode tcp")
+	}
+	if len(flags.denySNISuffix) != 0 {
+		server.DeniedSNI = new(SuffixSet)
+		for _, suffix := range flags.denySNISuffix {
+			server.DeniedSNI.Add(suffix)
 		}
-		server.Backend = &TCPDialer{
-			Port:    flags.backendPort,
-			Timeout: flags.timeout,
-			Allowed: flags.backendCidr,
+	}
+
+	if flags.tarpitDuration != 0 {
+		server.Tarpit = &Tarpit{Duration: flags.tarpitDuration, Max: flags.tarpitMax}
+	}
+	server.ResetOnError = flags.resetOnError
+	switch flags.allDown {
+	case "close", "retry":
+	case "tarpit":
+		if server.Tarpit == nil {
+			log.Fatal("-all-down-behaviour tarpit requires -tarpit-duration")
 		}
-	case "nat46":
-		if flags.proxyProto {
-			log.Fatal("-proxy-proto must not be specified when you use -mode nat46")
+		server.TarpitAllDown = true
+	default:
+		log.Fatal("-all-down-behaviour must be close, tarpit, or retry")
+	}
+	if flags.allDownRetry <= 0 {
+		log.Fatal("-all-down-retry-delay must be positive")
+	}
+
+	if flags.statsLogInterval < 0 {
+		log.Fatal("-stats-log-interval must not be negative")
+	} else if flags.statsLogInterval != 0 {
+		server.DialLatency = &DialLatencyReporter{Interval: flags.statsLogInterval}
+		go server.DialLatency.Run()
+	}
+
+	if flags.maxClientConns != 0 {
+		server.ClientConnLimit = &ClientConnLimit{Max: flags.maxClientConns}
+	}
+
+	if flags.maxLookups < 0 {
+		log.Fatal("-max-dns-lookups must not be negative")
+	}
+	if flags.topHostnames < 0 {
+		log.Fatal("-top-hostnames must not be negative")
+	} else if flags.topHostnames != 0 {
+		server.TopHostnames = &TopHostnames{Size: flags.topHostnames}
+	}
+	if flags.statsSocket != "" {
+		server.DrainedBackends = new(DrainedBackends)
+	}
+	if flags.auditLog != "" {
+		if flags.auditLogMaxSize < 0 || flags.auditLogFiles < 0 {
+			log.Fatal("-audit-log-max-size and -audit-log-max-files must not be negative")
 		}
-		if flags.backendPort != 0 {
-			log.Fatal("-backend-port must not be specified when you use -mode nat46")
+		auditLog, err := OpenAuditLog(flags.auditLog, flags.auditLogMaxSize, flags.auditLogFiles)
+		if err != nil {
+			log.Fatalf("Error opening -audit-log: %s", err)
 		}
-		if len(flags.backendCidr) == 0 {
-			log.Fatal("At least one -backend-cidr flag must be specified when you use -mode nat46")
+		defer auditLog.Close()
+		server.AuditLog = auditLog
+	}
+	if flags.geoIPDB != "" {
+		geoip, err := OpenGeoIP(flags.geoIPDB)
+		if err != nil {
+			log.Fatalf("Error opening -geoip-db: %s", err)
 		}
-		if flags.nat46Prefix == nil {
-			log.Fatal("-nat46-prefix must be specified when you use -mode nat46")
+		defer geoip.Close()
+		server.GeoIP = geoip
+	}
+	if flags.otlpTraces != "" {
+		server.Tracer = &OTLPTracer{Endpoint: flags.otlpTraces, Interval: 5 * time.Second, MaxSpans: 10000}
+		go server.Tracer.Run()
+	}
+	if flags.lastErrors < 0 {
+		log.Fatal("-last-backend-errors must not be negative")
+	} else if flags.lastErrors != 0 {
+		server.LastErrors = &LastErrors{Size: flags.lastErrors}
+	}
+
+	if flags.eventWebhook != "" {
+		types := strings.Split(flags.webhookEvents, ",")
+		for _, eventType := range types {
+			if eventType != EventAccepted && eventType != EventDenied && eventType != EventNoSNI {
+				log.Fatalf("-event-webhook-types: unknown event type %q", eventType)
+			}
 		}
-		server.Backend = &TCPDialer{
-			Allowed:          flags.backendCidr,
-			Timeout:          flags.timeout,
-			IPv6SourcePrefix: flags.nat46Prefix,
+		server.Webhook = NewWebhook(flags.eventWebhook, types, server.Metrics)
+	}
+
+	if flags.listenFile != "" {
+		specs, err := readListenFile(flags.listenFile)
+		if err != nil {
+			log.Fatalf("Error reading -listen-file: %s", err)
 		}
+		flags.listen = append(flags.listen, specs...)
+	}
+	if len(flags.listen) == 0 {
+		log.Fatal("At least one -listen flag or -listen-file must be specified")
+	}
+	if err := checkListenSpecs(flags.listen, flags.maxListeners); err != nil {
+		log.Fatal(err)
+	}
 
-		if flags.addRoute {
-			lo, err := netlink.LinkByName("lo")
-			if err != nil {
-				log.Fatalf("Could not find loopback interface: %s", err)
+	specModes, err := listenerModes(flags.listen, flags.mode, flags.listenerModes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	onlyUnix := !slices.ContainsFunc(specModes, func(mode string) bool { return mode != "unix" })
+	backends := make(map[string]BackendDialer)
+	for _, mode := range specModes {
+		if _, ok := backends[mode]; ok {
+			continue
+		}
+		var backend BackendDialer
+		switch mode {
+		case "unix":
+			if flags.unixDirectory == "" {
+				log.Fatal("-unix-directory must be specified when you use -mode unix")
+			}
+			// Options for TCP-based modes are fine if some listeners use one
+			if onlyUnix {
+				if flags.routeDir != "" {
+					log.Fatal("-route-dir must not be specified when you use -mode unix")
+				}
+				if flags.routeFile != "" {
+					log.Fatal("-route-file must not be specified when you use -mode unix")
+				}
+				if flags.backendFwmark != 0 {
+					log.Fatal("-backend-fwmark must not be specified when you use -mode unix")
+				}
+				if flags.userTimeout != 0 {
+					log.Fatal("-backend-user-timeout must not be specified when you use -mode unix")
+				}
+				if flags.allDown != "close" {
+					log.Fatal("-all-down-behaviour must not be specified when you use -mode unix")
+				}
+				if len(flags.hostnameCidr) != 0 {
+					log.Fatal("-hostname-cidr must not be specified when you use -mode unix")
+				}
+				if len(flags.excludeCidr) != 0 {
+					log.Fatal("-backend-exclude-cidr must not be specified when you use -mode unix")
+				}
+				if flags.srvService != "" {
+					log.Fatal("-srv-service must not be specified when you use -mode unix")
+				}
+				if flags.httpConnect != "" {
+					log.Fatal("-backend-http-connect must not be specified when you use -mode unix")
+				}
+				if len(flags.ptrSuffix) != 0 {
+					log.Fatal("-backend-ptr-suffix must not be specified when you use -mode unix")
+				}
+				if flags.backendResolver != "" {
+					log.Fatal("-backend-resolver must not be specified when you use -mode unix")
+				}
+				if flags.maxLookups != 0 {
+					log.Fatal("-max-dns-lookups must not be specified when you use -mode unix")
+				}
 			}
-			r := netlink.Route{
-				LinkIndex: lo.Attrs().Index,
-				Type:      unix.RTN_LOCAL,
-				Dst: &net.IPNet{
-					IP:   flags.nat46Prefix,
-					Mask: net.CIDRMask(96, 128),
-				},
-				Table: 255, // 255 is local table
+			backend = &UnixDialer{Directory: flags.unixDirectory, Shard: flags.unixShard}
+		case "tcp":
+			if len(flags.backendCidr) == 0 {
+				log.Fatal("At least one -backend-cidr flag must be specified when you use -mode tcp")
 			}
-			err = netlink.RouteAdd(&r)
-			if err != nil && !errors.Is(err, os.ErrExist) {
-				log.Fatalf("Failed to add route: %s", err)
+			backend = &TCPDialer{
+				Port:            flags.backendPort,
+				Timeout:         flags.timeout,
+				Allowed:         NewCIDRSet(flags.backendCidr),
+				Excluded:        NewCIDRSet(flags.excludeCidr),
+				HostnameAllowed: flags.hostnameCidr,
+				Mark:            flags.backendFwmark,
+				SRVService:      strings.TrimPrefix(flags.srvService, "_"),
+				SRVProto:        strings.TrimPrefix(flags.srvProto, "_"),
+				Resolver:        openBackendResolver(flags.backendResolver, flags.checkResolver),
 			}
-			defer func() {
-				err = netlink.RouteDel(&r)
-				if err != nil && !errors.Is(err, syscall.ESRCH) {
-					log.Printf("Failed to remove route: %s", err)
+		case "spray":
+			if len(flags.backendCidr) == 0 {
+				log.Fatal("At least one -backend-cidr flag must be specified when you use -mode spray")
+			}
+			if len(flags.sprayBackends) == 0 {
+				log.Fatal("-spray-backends must be specified when you use -mode spray")
+			}
+			if flags.routeDir != "" || flags.routeFile != "" {
+				log.Fatal("-route-dir and -route-file must not be specified when you use -mode spray")
+			}
+			dialer := &TCPDialer{
+				Port:            flags.backendPort,
+				Timeout:         flags.timeout,
+				Allowed:         NewCIDRSet(flags.backendCidr),
+				Excluded:        NewCIDRSet(flags.excludeCidr),
+				HostnameAllowed: flags.hostnameCidr,
+				Mark:            flags.backendFwmark,
+				Spray:           flags.sprayBackends,
+			}
+			for _, spray := range flags.sprayBackends {
+				if err := dialer.checkRoute("", &Route{Backend: spray.Address}); err != nil {
+					log.Fatalf("Invalid -spray-backends: %s", err)
 				}
-			}()
+			}
+			backend = dialer
+		case "nat46":
+			if flags.proxyProto {
+				log.Fatal("-proxy-proto must not be specified when you use -mode nat46")
+			}
+			if flags.backendPort != 0 {
+				log.Fatal("-backend-port must not be specified when you use -mode nat46")
+			}
+			if len(flags.backendCidr) == 0 {
+				log.Fatal("At least one -backend-cidr flag must be specified when you use -mode nat46")
+			}
+			if flags.nat46Prefix == nil {
+				log.Fatal("-nat46-prefix must be specified when you use -mode nat46")
+			}
+			backend = &TCPDialer{
+				Allowed:          NewCIDRSet(flags.backendCidr),
+				Excluded:         NewCIDRSet(flags.excludeCidr),
+				HostnameAllowed:  flags.hostnameCidr,
+				Timeout:          flags.timeout,
+				IPv6SourcePrefix: flags.nat46Prefix,
+				Mark:             flags.backendFwmark,
+				SRVService:       strings.TrimPrefix(flags.srvService, "_"),
+				SRVProto:         strings.TrimPrefix(flags.srvProto, "_"),
+				Resolver:         openBackendResolver(flags.backendResolver, flags.checkResolver),
+			}
+
+			if flags.addRoute {
+				defer addLocalRoute(&net.IPNet{IP: flags.nat46Prefix, Mask: net.CIDRMask(96, 128)})()
+			}
+		case "nat64":
+			if flags.proxyProto {
+				log.Fatal("-proxy-proto must not be specified when you use -mode nat64")
+			}
+			if flags.backendPort != 0 {
+				log.Fatal("-backend-port must not be specified when you use -mode nat64")
+			}
+			if len(flags.backendCidr) == 0 {
+				log.Fatal("At least one -backend-cidr flag must be specified when you use -mode nat64")
+			}
+			if flags.nat64Prefix == nil {
+				log.Fatal("-nat64-prefix must be specified when you use -mode nat64")
+			}
+			backend = &TCPDialer{
+				Allowed:          NewCIDRSet(flags.backendCidr),
+				Excluded:         NewCIDRSet(flags.excludeCidr),
+				HostnameAllowed:  flags.hostnameCidr,
+				Timeout:          flags.timeout,
+				IPv4SourcePrefix: flags.nat64Prefix,
+				Mark:             flags.backendFwmark,
+				SRVService:       strings.TrimPrefix(flags.srvService, "_"),
+				SRVProto:         strings.TrimPrefix(flags.srvProto, "_"),
+				Resolver:         openBackendResolver(flags.backendResolver, flags.checkResolver),
+			}
+
+			if flags.addRoute {
+				defer addLocalRoute(flags.nat64Prefix)()
+			}
+		default:
+			log.Fatal("-mode must be unix, tcp, nat46, nat64, or spray")
 		}
-	default:
-		log.Fatal("-mode must be unix, tcp, or nat46")
+		backends[mode] = backend
 	}
+	if len(flags.sprayBackends) != 0 && !slices.Contains(specModes, "spray") {
+		log.Fatal("-spray-backends must not be specified unless you use -mode spray")
+	}
+	server.Backend = backends[specModes[0]]
 
-	if len(flags.listen) == 0 {
-		log.Fatal("At least one -listen flag must be specified")
+	// Every TCP-based backend shares the same routes, except in spray
+	// mode, where routes aren't used
+	var tcpDialers []*TCPDialer
+	var routedDialer *TCPDialer
+	for _, mode := range modes {
+		if dialer, ok := backends[mode].(*TCPDialer); ok {
+			tcpDialers = append(tcpDialers, dialer)
+			if routedDialer == nil && len(dialer.Spray) == 0 {
+				routedDialer = dialer
+			}
+		}
+	}
+	if routedDialer == nil && (flags.routeDir != "" || flags.routeFile != "") {
+		log.Fatal("-route-dir and -route-file require a listener using -mode tcp, nat46, or nat64")
+	}
+	if flags.routeFile != "" {
+		if flags.routeDir != "" {
+			log.Fatal("-route-dir and -route-file must not both be specified")
+		}
+		server.Routes = NewRouteTable()
+		if err := LoadRouteFile(server.Routes, flags.routeFile, routedDialer.checkRoute); err != nil {
+			log.Fatalf("Failed to load routes from -route-file: %s", err)
+		}
+	} else {
+		server.Routes = openRouteDir(flags.routeDir)
+	}
+	if server.Routes != nil {
+		server.Routes.PinnedGauge = server.Metrics.routeGenerations
+	}
+	for _, dialer := range tcpDialers {
+		if len(dialer.Spray) == 0 {
+			dialer.Routes = server.Routes
+		}
+		dialer.Metrics = server.Metrics
+		dialer.MaxLookups = flags.maxLookups
+		dialer.UserTimeout = flags.userTimeout
+		dialer.HTTPConnectProxy = flags.httpConnect
+		dialer.HTTPConnectHeaders = flags.httpConnectHdrs
+		if len(flags.ptrSuffix) != 0 {
+			dialer.PTRChecker = &PTRChecker{Suffixes: new(SuffixSet), Resolver: dialer.Resolver}
+			for _, suffix := range flags.ptrSuffix {
+				dialer.PTRChecker.Suffixes.Add(suffix)
+			}
+		}
+		if flags.allDown == "retry" {
+			dialer.AllDownRetry = flags.allDownRetry
+		}
+	}
+
+	if flags.observeOnly {
+		server.ObserveOnly = true
+		for _, backend := range backends {
+			switch dialer := backend.(type) {
+			case *UnixDialer:
+				dialer.Observe = true
+			case *TCPDialer:
+				dialer.Observe = true
+			}
+		}
+	}
+
+	if flags.catchAllBackend != "" {
+		for _, backend := range backends {
+			switch dialer := backend.(type) {
+			case *UnixDialer:
+				dialer.CatchAll = flags.catchAllBackend
+			case *TCPDialer:
+				address, err := parseRouteBackend(flags.catchAllBackend)
+				if err != nil {
+					log.Fatalf("Invalid -catch-all-backend: %s", err)
+				}
+				if err := dialer.checkRoute("", &Route{Backend: address}); err != nil {
+					log.Fatalf("Invalid -catch-all-backend: %s", err)
+				}
+				dialer.CatchAll = address
+			}
+		}
 	}
 
-	listeners, err := listener.OpenAll(flags.listen)
+	var listeners []net.Listener
+	if flags.reusePort {
+		listeners, err = openAllReusePort(flags.listen)
+	} else {
+		listeners, err = listener.OpenAll(flags.listen)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer listener.CloseAll(listeners)
+	if err := checkListenerAddrs(flags.listen, listeners); err != nil {
+		log.Fatal(err)
+	}
+	server.ListenerBackends = make(map[string]BackendDialer)
+	for i, l := range listeners {
+		server.ListenerBackends[l.Addr().String()] = backends[specModes[i]]
+	}
+	for _, dialer := range tcpDialers {
+		dialer.SetListeners(listeners)
+		dialer.warnLoopingRoutes()
+	}
+
+	// shutdown is done once snid receives a termination signal, after
+	// which errors from the listeners are expected
+	shutdown, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	readiness := new(Readiness)
+	if flags.startupDelay > 0 {
+		readiness.SetWarming(true)
+		server.Readiness = readiness
+		time.AfterFunc(flags.startupDelay, func() {
+			if readiness.SetWarming(false) {
+				log.Printf("Warmup ended after -startup-delay of %s", flags.startupDelay)
+			}
+		})
+	}
 
 	for _, l := range listeners {
-		go serve(l, server)
+		go serve(shutdown, l, server)
+	}
+
+	proxyTLVs := []int{}
+	for _, tlvType := range flags.proxyTLVs {
+		proxyTLVs = append(proxyTLVs, int(tlvType))
+	}
+	logEffectiveConfig(map[string]any{
+		"mode":                    flags.mode,
+		"listener_mode":           flags.listenerModes,
+		"spray_backends":          flags.sprayBackends,
+		"listen":                  flags.listen,
+		"listen_file":             flags.listenFile,
+		"max_listeners":           flags.maxListeners,
+		"max_dns_lookups":         flags.maxLookups,
+		"observe_only":            flags.observeOnly,
+		"default_hostname":        flags.defaultHostname,
+		"ip_literal_sni_hostname": flags.ipLiteralSNI,
+		"psk_route_prefix":        flags.pskRoutePrefix,
+		"normalize_idn":           flags.normalizeIDN,
+		"reject_bogus_hello":      flags.rejectBogusHello,
+		"min_tls_version":         flags.minTLSVersion,
+		"require_alpn":            flags.requireALPN,
+		"require_fqdn":            flags.requireFQDN,
+		"allow_single_label_sni":  flags.allowSingleLabel,
+		"allow_sni_suffix":        flags.allowSNISuffix,
+		"deny_sni_suffix":         flags.denySNISuffix,
+		"lenient_sni_port":        flags.lenientSNIPort,
+		"backend_cidr":            cidrStrings(flags.backendCidr),
+		"backend_exclude_cidr":    cidrStrings(flags.excludeCidr),
+		"hostname_cidr":           hostnameCIDRStrings(flags.hostnameCidr),
+		"backend_port":            flags.backendPort,
+		"backend_fwmark":          flags.backendFwmark,
+		"backend_user_timeout":    flags.userTimeout.String(),
+		"backend_resolver":        flags.backendResolver,
+		"unix_directory":          flags.unixDirectory,
+		"unix_shard":              flags.unixShard,
+		"unix_full_close":         flags.unixFullClose,
+		"nat46_prefix":            ipString(flags.nat46Prefix),
+		"nat64_prefix":            cidrStrings([]*net.IPNet{flags.nat64Prefix}),
+		"route_dir":               flags.routeDir,
+		"route_file":              flags.routeFile,
+		"catch_all_backend":       flags.catchAllBackend,
+		"srv_service":             flags.srvService,
+		"backend_http_connect":    flags.httpConnect,
+		"backend_ptr_suffix":      flags.ptrSuffix,
+		"srv_proto":               flags.srvProto,
+		"timeout":                 flags.timeout.String(),
+		"first_byte_timeout":      flags.firstByteTimeout.String(),
+		"idle_timeout":            flags.idleTimeout.String(),
+		"max_lifetime":            flags.maxLifetime.String(),
+		"lifetime_extension":      flags.lifetimeExt,
+		"lifetime_extension_cap":  flags.lifetimeExtCap.String(),
+		"header_timeout":          flags.headerTimeout.String(),
+		"close_write_delay":       flags.closeWriteDelay.String(),
+		"no_half_close":           flags.noHalfClose,
+		"nodelay":                 flags.noDelay,
+		"proxy_proto":             flags.proxyProto,
+		"accept_proxy_proto":      flags.acceptProxyProto,
+		"proxy_trusted_cidr":      cidrStrings(flags.trustedProxyCidr),
+		"proxy_tlv":               proxyTLVs,
+		"backend_proxy_proto":     flags.proxyVersions,
+		"backend_preamble":        hostnameHexStrings(flags.preambles),
+		"max_conns_per_client":    flags.maxClientConns,
+		"max_handlers":            flags.maxHandlers,
+		"peek_memory_budget":      flags.peekBudget,
+		"max_bytes_per_conn":      flags.maxBytes,
+		"max_bytes_mode":          flags.maxBytesMode,
+		"max_fds":                 flags.maxFDs,
+		"tarpit_duration":         flags.tarpitDuration.String(),
+		"error_close_reset":       flags.resetOnError,
+		"all_down_behaviour":      flags.allDown,
+		"all_down_retry_delay":    flags.allDownRetry.String(),
+		"tarpit_max":              flags.tarpitMax,
+		"reuseport":               flags.reusePort,
+		"metrics_addr":            flags.metricsAddr,
+		"metrics_backend":         flags.metricsBackend,
+		"metrics_exemplars":       flags.exemplars,
+		"otlp_endpoint":           flags.otlpEndpoint,
+		"otlp_traces_endpoint":    flags.otlpTraces,
+		"metrics_push_url":        flags.pushURL,
+		"event_webhook":           flags.eventWebhook,
+		"event_webhook_types":     flags.webhookEvents,
+		"startup_probe_hostname":  flags.probeHostname,
+		"startup_delay":           flags.startupDelay.String(),
+		"proxy_proto_probe":       flags.proxyProbe,
+		"stats_socket":            flags.statsSocket,
+		"top_hostnames":           flags.topHostnames,
+		"last_backend_errors":     flags.lastErrors,
+		"audit_log":               flags.auditLog,
+		"audit_log_max_size":      flags.auditLogMaxSize,
+		"audit_log_max_files":     flags.auditLogFiles,
+		"geoip_db":                flags.geoIPDB,
+		"drain_file":              flags.drainFile,
+		"stats_log_interval":      flags.statsLogInterval.String(),
+		"trace_sample_rate":       flags.traceSampleRate,
+		"reject_log_sample_rate":  flags.rejectLogRate,
+		"log_connections":         flags.logConnections,
+		"log_flows":               flags.logFlows,
+		"debug_dump_failed_hello": flags.dumpFailedHello,
+	})
+
+	if flags.probeHostname == "" {
+		readiness.SetReady(true)
+	} else {
+		go runStartupProbe(server.Backend, flags.probeHostname, probeClientConn{addr: listeners[0].Addr()}, readiness)
+	}
+	if flags.proxyProbe != "" {
+		go runProxyProtoProbe(server, flags.proxyProbe, probeClientConn{addr: listeners[0].Addr()}, readiness)
+	}
+
+	if flags.drainFile != "" {
+		err := WatchDrainFile(flags.drainFile, func(draining bool) {
+			readiness.SetDraining(draining)
+			server.SetDraining(draining)
+		})
+		if err != nil {
+			log.Fatalf("Failed to watch -drain-file: %s", err)
+		}
+	}
+
+	if flags.statsSocket != "" {
+		statsListener, err := listenStatsSocket(flags.statsSocket)
+		if err != nil {
+			log.Fatalf("Failed to listen on -stats-socket: %s", err)
+		}
+		defer statsListener.Close()
+		mode := flags.mode
+		if len(flags.listenerModes) != 0 {
+			mode = "per-listener"
+		}
+		socket := &StatsSocket{
+			Metrics:   server.Metrics,
+			Readiness: readiness,
+			Mode:      mode,
+			Listeners: flags.listen,
+
+			TopHostnames: server.TopHostnames,
+			LastErrors:   server.LastErrors,
+
+			DrainedBackends: server.DrainedBackends,
+		}
+		go func() {
+			if err := socket.Serve(statsListener); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	if flags.metricsAddr != "" {
+		metricsListener, err := listener.Open(metricsListenSpec(flags.metricsAddr))
+		if err != nil {
+			log.Fatalf("Error listening on -metrics-addr: %s", err)
+		}
+		defer metricsListener.Close()
+		go func() {
+			if err := serveHTTP(metricsListener, server.Metrics, readiness); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	switch flags.metricsBackend {
+	case "prometheus":
+	case "otlp":
+		if flags.otlpEndpoint == "" {
+			log.Fatal("-otlp-endpoint must be specified when you use -metrics-backend otlp")
+		}
+		if flags.otlpInterval <= 0 {
+			log.Fatal("-otlp-interval must be positive")
+		}
+		exporter := &OTLPExporter{
+			Endpoint: flags.otlpEndpoint,
+			Interval: flags.otlpInterval,
+			Gatherer: server.Metrics.Registry,
+		}
+		go exporter.Run()
+	default:
+		log.Fatal("-metrics-backend must be prometheus or otlp")
+	}
+
+	var pushgateway *PushgatewayExporter
+	if flags.pushURL != "" {
+		if flags.pushInterval <= 0 {
+			log.Fatal("-metrics-push-interval must be positive")
+		}
+		pushgateway = &PushgatewayExporter{
+			URL:      flags.pushURL,
+			Job:      flags.pushJob,
+			Grouping: flags.pushGrouping,
+			Interval: flags.pushInterval,
+			Gatherer: server.Metrics.Registry,
+		}
+		go pushgateway.Run()
 	}
 
 	// Wait for termination signal and exit cleanly
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	stopping = true
+	<-shutdown.Done()
+
+	if pushgateway != nil {
+		if err := pushgateway.Push(); err != nil {
+			log.Printf("Error pushing final metrics to %s: %s", pushgateway.URL, err)
+		}
+	}
+}
+
+// addLocalRoute inserts a route for dst into the local routing table,
+// and returns a function that removes it
+func addLocalRoute(dst *net.IPNet) func() {
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		log.Fatalf("Could not find loopback interface: %s", err)
+	}
+	r := netlink.Route{
+		LinkIndex: lo.Attrs().Index,
+		Type:      unix.RTN_LOCAL,
+		Dst:       dst,
+		Table:     255, // 255 is local table
+	}
+	err = netlink.RouteAdd(&r)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		log.Fatalf("Failed to add route: %s", err)
+	}
+	return func() {
+		err := netlink.RouteDel(&r)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			log.Printf("Failed to remove route: %s", err)
+		}
+	}
+}
+
+// logEffectiveConfig logs config as a single line of JSON, with keys in
+// sorted order so that it's easy to diff
+func logEffectiveConfig(config map[string]any) {
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		log.Fatalf("Failed to encode effective configuration: %s", err)
+	}
+	log.Printf("Effective configuration: %s", configJSON)
+}
+
+func cidrStrings(cidrs []*net.IPNet) []string {
+	strs := []string{}
+	for _, cidr := range cidrs {
+		if cidr != nil {
+			strs = append(strs, cidr.String())
+		}
+	}
+	return strs
+}
+
+func hostnameCIDRStrings(hostnameCidrs map[string][]*net.IPNet) map[string][]string {
+	strs := make(map[string][]string)
+	for hostname, cidrs := range hostnameCidrs {
+		strs[hostname] = cidrStrings(cidrs)
+	}
+	return strs
+}
+
+func hostnameHexStrings(hostnameBytes map[string][]byte) map[string]string {
+	strs := make(map[string]string)
+	for hostname, b := range hostnameBytes {
+		strs[hostname] = hex.EncodeToString(b)
+	}
+	return strs
+}
+
+// parsePreamble parses either a hex string, or @ followed by the path of
+// a file containing the preamble
+func parsePreamble(arg string) ([]byte, error) {
+	var preamble []byte
+	if path, ok := strings.CutPrefix(arg, "@"); ok {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		preamble = contents
+	} else {
+		decoded, err := hex.DecodeString(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex: %w", err)
+		}
+		preamble = decoded
+	}
+	if len(preamble) == 0 {
+		return nil, fmt.Errorf("preamble is empty")
+	}
+	return preamble, nil
+}
+
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func openRouteDir(dir string) *RouteTable {
+	if dir == "" {
+		return nil
+	}
+	routes := NewRouteTable()
+	if err := WatchRouteDir(routes, dir); err != nil {
+		log.Fatalf("Failed to load routes from -route-dir: %s", err)
+	}
+	return routes
+}
+
+func openBackendResolver(address string, check bool) *net.Resolver {
+	if address == "" {
+		return nil
+	}
+	resolver := newResolver(address)
+	if check {
+		if err := checkResolver(resolver); err != nil {
+			log.Fatalf("-backend-resolver %s is not responding: %s", address, err)
+		}
+	}
+	return resolver
 }
 
-func serve(listener net.Listener, server *Server) {
-	err := server.Serve(listener)
+func serve(shutdown context.Context, listener net.Listener, server *Server) {
+	err := server.ServeContext(shutdown, listener)
 	if nil != err && !errors.Is(err, net.ErrClosed) {
-		if stopping {
+		if shutdown.Err() != nil {
 			log.Print(err)
 		} else {
 			log.Fatal(err)
@@ -0,0 +1,295 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	// If true, backend dial durations are observed with an exemplar
+	// containing the client's address, and metrics are served in the
+	// OpenMetrics format (which is needed to expose exemplars) when the
+	// scraper asks for it
+	Exemplars bool
+
+	handshakePeeks    *prometheus.CounterVec
+	errors            *prometheus.CounterVec
+	echHandshakes     *prometheus.CounterVec
+	ipLiteralSNI      *prometheus.CounterVec
+	bogusHellos       *prometheus.CounterVec
+	warmupRejected    *prometheus.CounterVec
+	rejections        *prometheus.CounterVec
+	countries         *prometheus.CounterVec
+	webhookDrops      *prometheus.CounterVec
+	tarpitted         *prometheus.CounterVec
+	streamCloses      *prometheus.CounterVec
+	writeBlocked      *prometheus.CounterVec
+	observedDecisions *prometheus.CounterVec
+	sprayed           *prometheus.CounterVec
+	routeGenerations  *prometheus.GaugeVec
+	resolvedAddresses *prometheus.HistogramVec
+	dialDuration      *prometheus.HistogramVec
+	throughput        *throughputTracker
+
+	activeHandlers  prometheus.Gauge
+	lookupsInFlight prometheus.Gauge
+	peekMemory      prometheus.Gauge
+	lookupsShed     prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		handshakePeeks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "tls_handshake_peek_total",
+			Help:      "Number of attempts to peek a ClientHello from a client, by result.",
+		}, []string{"listener", "family", "result"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "connection_errors_total",
+			Help:      "Number of connections which failed, by error.",
+		}, []string{"listener", "family", "error"}),
+		echHandshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "tls_ech_handshakes_total",
+			Help:      "Number of ClientHellos which use Encrypted Client Hello.",
+		}, []string{"listener", "family"}),
+		ipLiteralSNI: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "ip_literal_sni_total",
+			Help:      "Number of ClientHellos whose SNI hostname is an IP address, by whether they were rejected or rerouted.",
+		}, []string{"listener", "family", "result"}),
+		bogusHellos: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "bogus_hellos_total",
+			Help:      "Number of ClientHellos which offer no cipher suites other than GREASE values.",
+		}, []string{"listener", "family"}),
+		warmupRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "warmup_rejected_connections_total",
+			Help:      "Number of connections closed because they arrived during -startup-delay.",
+		}, []string{"listener", "family"}),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "rejections_total",
+			Help:      "Number of connections rejected by a policy rule, by the flag which configures the rule.",
+		}, []string{"listener", "family", "rule"}),
+		countries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "client_country_connections_total",
+			Help:      "Number of connections, by the country of the client's address in -geoip-db.",
+		}, []string{"listener", "family", "country"}),
+		routeGenerations: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "snid",
+			Name:      "route_generation_connections",
+			Help:      "Number of established connections to routed hostnames, by the generation of the routes they were routed under.",
+		}, []string{"generation"}),
+		webhookDrops: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "webhook_events_dropped_total",
+			Help:      "Number of webhook events which were not delivered, by reason.",
+		}, []string{"reason"}),
+		tarpitted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "tarpitted_connections_total",
+			Help:      "Number of rejected connections which were held open by the tarpit.",
+		}, []string{"listener", "family"}),
+		streamCloses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "stream_close_total",
+			Help:      "Number of proxied connections which ended, by which side closed its stream first.",
+		}, []string{"initiator"}),
+		writeBlocked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "backend_write_blocked_seconds_total",
+			Help:      "Time spent writing client data to the backend, which is mostly time blocked waiting for the backend to read.",
+		}, []string{"backend"}),
+		observedDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "observed_decisions_total",
+			Help:      "Number of routing decisions made in observe-only mode, by result.",
+		}, []string{"result"}),
+		sprayed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "spray_connections_total",
+			Help:      "Number of connections sprayed to each backend in spray mode.",
+		}, []string{"backend"}),
+		resolvedAddresses: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "snid",
+			Name:      "backend_resolved_addresses",
+			Help:      "Number of allowed addresses that backend hostnames resolved to.",
+			Buckets:   []float64{0, 1, 2, 3, 4, 6, 8, 16},
+		}, []string{"listener", "family"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "snid",
+			Name:      "backend_dial_duration_seconds",
+			Help:      "Time taken to successfully connect to backends.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"listener", "family"}),
+		throughput: newThroughputTracker(),
+		activeHandlers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "snid",
+			Name:      "active_handlers",
+			Help:      "Number of connections currently being handled.",
+		}),
+		lookupsInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "snid",
+			Name:      "dns_lookups_in_flight",
+			Help:      "Number of DNS lookups of backends currently in flight.",
+		}),
+		peekMemory: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "snid",
+			Name:      "peek_memory_bytes",
+			Help:      "Number of bytes buffered by connections whose ClientHello is being read, counted against -peek-memory-budget.",
+		}),
+		lookupsShed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "snid",
+			Name:      "dns_lookups_shed_total",
+			Help:      "Number of DNS lookups of backends which were abandoned because too many were in flight.",
+		}),
+	}
+	metrics.Registry.MustRegister(metrics.handshakePeeks, metrics.errors, metrics.echHandshakes, metrics.ipLiteralSNI, metrics.bogusHellos, metrics.warmupRejected, metrics.rejections, metrics.countries, metrics.webhookDrops, metrics.tarpitted, metrics.streamCloses, metrics.writeBlocked, metrics.observedDecisions, metrics.sprayed, metrics.routeGenerations, metrics.resolvedAddresses, metrics.dialDuration, metrics.throughput, metrics.activeHandlers, metrics.lookupsInFlight, metrics.lookupsShed, metrics.peekMemory)
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "snid",
+		Name:      "open_fds",
+		Help:      "Number of open file descriptors.",
+	}, func() float64 {
+		n, err := countOpenFiles()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(n)
+	}))
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "snid",
+		Name:      "goroutines",
+		Help:      "Number of goroutines.",
+	}, func() float64 {
+		return float64(runtime.NumGoroutine())
+	}))
+	return metrics
+}
+
+// listenerLabels identifies a listener in metric labels.  family is one of
+// inet, inet6, or unix, so that traffic can be aggregated by address family.
+type listenerLabels struct {
+	name    string
+	family  string
+	metrics *listenerMetrics
+}
+
+// listenerMetrics holds the metrics of a single listener, looked up once
+// when the listener is served rather than for every connection
+type listenerMetrics struct {
+	peeksOK           prometheus.Counter
+	peeksFailed       prometheus.Counter
+	errors            *prometheus.CounterVec
+	echHandshakes     prometheus.Counter
+	ipLiteralRejected prometheus.Counter
+	ipLiteralRerouted prometheus.Counter
+	bogusHellos       prometheus.Counter
+	warmupRejected    prometheus.Counter
+	rejections        *prometheus.CounterVec
+	countries         *prometheus.CounterVec
+	tarpitted         prometheus.Counter
+	resolvedAddresses prometheus.Observer
+	dialDuration      prometheus.Observer
+}
+
+func (metrics *Metrics) newListenerLabels(addr net.Addr) listenerLabels {
+	labels := listenerLabels{name: addr.String(), family: addr.Network()}
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		if addr.IP.To4() != nil {
+			labels.family = "inet"
+		} else {
+			labels.family = "inet6"
+		}
+	case *net.UnixAddr:
+		labels.family = "unix"
+	}
+	curried := prometheus.Labels{"listener": labels.name, "family": labels.family}
+	labels.metrics = &listenerMetrics{
+		peeksOK:           metrics.handshakePeeks.WithLabelValues(labels.name, labels.family, "ok"),
+		peeksFailed:       metrics.handshakePeeks.WithLabelValues(labels.name, labels.family, "fail"),
+		errors:            metrics.errors.MustCurryWith(curried),
+		echHandshakes:     metrics.echHandshakes.WithLabelValues(labels.name, labels.family),
+		ipLiteralRejected: metrics.ipLiteralSNI.WithLabelValues(labels.name, labels.family, "rejected"),
+		ipLiteralRerouted: metrics.ipLiteralSNI.WithLabelValues(labels.name, labels.family, "rerouted"),
+		bogusHellos:       metrics.bogusHellos.WithLabelValues(labels.name, labels.family),
+		warmupRejected:    metrics.warmupRejected.WithLabelValues(labels.name, labels.family),
+		rejections:        metrics.rejections.MustCurryWith(curried),
+		countries:         metrics.countries.MustCurryWith(curried),
+		tarpitted:         metrics.tarpitted.WithLabelValues(labels.name, labels.family),
+		resolvedAddresses: metrics.resolvedAddresses.WithLabelValues(labels.name, labels.family),
+		dialDuration:      metrics.dialDuration.WithLabelValues(labels.name, labels.family),
+	}
+	return labels
+}
+
+func (metrics *Metrics) countError(listener listenerLabels, err error) {
+	listener.metrics.errors.WithLabelValues(errorLabelValue(err)).Inc()
+}
+
+// reject counts a connection rejected by the policy rule configured by the
+// named flag, and returns err for convenience
+func (metrics *Metrics) reject(listener listenerLabels, rule string, err error) error {
+	listener.metrics.rejections.WithLabelValues(rule).Inc()
+	return err
+}
+
+// observeDialDuration observes duration, with an exemplar linking it to
+// the trace traceID if exemplars are enabled and the connection is traced
+func (metrics *Metrics) observeDialDuration(listener listenerLabels, traceID string, duration time.Duration) {
+	observer := listener.metrics.dialDuration
+	if metrics.Exemplars && traceID != "" {
+		observer.(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceID})
+	} else {
+		observer.Observe(duration.Seconds())
+	}
+}
+
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{EnableOpenMetrics: metrics.Exemplars})
+}
+
+func serveHTTP(listener net.Listener, metrics *Metrics, readiness *Readiness) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/readyz", readiness)
+	return http.Serve(listener, mux)
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricValue returns the current value of metric
+func metricValue(tb testing.TB, metric prometheus.Metric) *dto.Metric {
+	tb.Helper()
+	value := new(dto.Metric)
+	if err := metric.Write(value); err != nil {
+		tb.Fatal(err)
+	}
+	return value
+}
+
+func TestObserveDialDurationExemplar(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.Exemplars = true
+	listener := metrics.newListenerLabels(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443})
+	histogram := func() *dto.Histogram {
+		return metricValue(t, listener.metrics.dialDuration.(prometheus.Metric)).GetHistogram()
+	}
+
+	// An untraced connection has no trace ID to link to
+	metrics.observeDialDuration(listener, "", time.Millisecond)
+	for _, bucket := range histogram().GetBucket() {
+		if bucket.GetExemplar() != nil {
+			t.Fatalf("untraced observation has exemplar %v", bucket.GetExemplar())
+		}
+	}
+
+	traceID := newTraceID()
+	metrics.observeDialDuration(listener, traceID, time.Millisecond)
+	var exemplars []*dto.Exemplar
+	for _, bucket := range histogram().GetBucket() {
+		if exemplar := bucket.GetExemplar(); exemplar != nil {
+			exemplars = append(exemplars, exemplar)
+		}
+	}
+	if len(exemplars) != 1 {
+		t.Fatalf("got %d exemplars, want 1", len(exemplars))
+	}
+	labels := exemplars[0].GetLabel()
+	if len(labels) != 1 || labels[0].GetName() != "trace_id" || labels[0].GetValue() != traceID {
+		t.Errorf("exemplar has labels %v, want trace_id=%s", labels, traceID)
+	}
+}
+
+// BenchmarkConnectionMetrics measures the metric updates made for a
+// typical connection, using the handles looked up once per listener, and
+// compares them with looking up each metric by its labels every time.
+// (The write-blocked counter is labeled by backend, so it's looked up once
+// per connection either way.)
+func BenchmarkConnectionMetrics(b *testing.B) {
+	metrics := NewMetrics()
+	listener := metrics.newListenerLabels(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443})
+	traceID := newTraceID()
+
+	b.Run("per-listener", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			listener.metrics.peeksOK.Inc()
+			metrics.observeDialDuration(listener, traceID, time.Millisecond)
+			metrics.writeBlocked.WithLabelValues("other").Add(0.001)
+			metrics.countError(listener, io.EOF)
+		}
+	})
+	b.Run("per-listener-exemplars", func(b *testing.B) {
+		metrics.Exemplars = true
+		defer func() { metrics.Exemplars = false }()
+		b.ReportAllocs()
+		for b.Loop() {
+			listener.metrics.peeksOK.Inc()
+			metrics.observeDialDuration(listener, traceID, time.Millisecond)
+			metrics.writeBlocked.WithLabelValues("other").Add(0.001)
+			metrics.countError(listener, io.EOF)
+		}
+	})
+	b.Run("WithLabelValues", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			metrics.handshakePeeks.WithLabelValues(listener.name, listener.family, "ok").Inc()
+			metrics.dialDuration.WithLabelValues(listener.name, listener.family).Observe(time.Millisecond.Seconds())
+			metrics.writeBlocked.WithLabelValues("other").Add(0.001)
+			metrics.errors.WithLabelValues(listener.name, listener.family, errorLabelValue(io.EOF)).Inc()
+		}
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseNAT46Prefix parses an IPv6 prefix, specified either as an address
+// or as a CIDR, making sure that it leaves exactly 32 bits in which to
+// embed the client's IPv4 address
+func parseNAT46Prefix(arg string) (net.IP, error) {
+	var prefix net.IP
+	if strings.Contains(arg, "/") {
+		ip, ipnet, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, err
+		}
+		if ones, bits := ipnet.Mask.Size(); bits != 8*net.IPv6len || ones != 96 {
+			return nil, fmt.Errorf("prefix length must be /96 so that it leaves 32 bits for the IPv4 address")
+		}
+		prefix = ip
+	} else {
+		prefix = net.ParseIP(arg)
+		if prefix == nil {
+			return nil, fmt.Errorf("not a valid IP address")
+		}
+	}
+	if prefix.To4() != nil {
+		return nil, fmt.Errorf("not an IPv6 address")
+	}
+	if masked := prefix.Mask(net.CIDRMask(96, 128)); !prefix.Equal(masked) {
+		return nil, fmt.Errorf("lower 32 bits must be zero because they are replaced with the client's IPv4 address (did you mean %s?)", masked)
+	}
+	return prefix, nil
+}
+
+// nat46SourceAddress returns the IPv6 source address for a client
+// connecting over IPv4, by placing the client's IPv4 address in the lower
+// 32 bits of prefix
+func nat46SourceAddress(prefix net.IP, clientIPv4 net.IP) net.IP {
+	source := make(net.IP, net.IPv6len)
+	copy(source[:12], prefix.To16())
+	copy(source[12:], clientIPv4.To4())
+	return source
+}
+
+// nat64SourceAddress returns the IPv4 source address for a client
+// connecting over IPv6, by placing the lowest-order bits of the client's
+// IPv6 address in the host bits of prefix.  Unlike NAT46, the mapping is
+// lossy: all clients whose addresses share those bits get the same source
+// address.
+func nat64SourceAddress(prefix *net.IPNet, clientIPv6 net.IP) net.IP {
+	network := prefix.IP.To4()
+	client := clientIPv6.To16()[12:]
+	source := make(net.IP, net.IPv4len)
+	for i := range source {
+		source[i] = network[i]&prefix.Mask[i] | client[i]&^prefix.Mask[i]
+	}
+	return source
+}
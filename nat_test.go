@@ -0,0 +1,122 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNAT64SourceAddress(t *testing.T) {
+	tests := []struct {
+		prefix string
+		client string
+		want   string
+	}{
+		{"0.0.0.0/0", "2001:db8::c000:201", "192.0.2.1"},
+		{"0.0.0.0/0", "2001:db8::ffff:ffff", "255.255.255.255"},
+		{"192.0.2.1/32", "2001:db8::ffff:ffff", "192.0.2.1"},
+		{"192.0.2.1/32", "2001:db8::", "192.0.2.1"},
+		{"10.0.0.0/8", "2001:db8::ffff:ffff", "10.255.255.255"},
+		{"10.0.0.0/8", "2001:db8::1", "10.0.0.1"},
+		{"100.64.0.0/10", "2001:db8::ffff:ffff", "100.127.255.255"},
+		{"100.64.0.0/10", "2001:db8::40:0", "100.64.0.0"},
+		{"198.51.100.0/24", "2001:db8::1:2:3:4ff", "198.51.100.255"},
+		{"198.51.100.0/24", "::ffff:192.0.2.7", "198.51.100.7"},
+	}
+	for _, test := range tests {
+		_, prefix, err := net.ParseCIDR(test.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := nat64SourceAddress(prefix, net.ParseIP(test.client))
+		if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("nat64SourceAddress(%s, %s) = %s, want %s", test.prefix, test.client, got, test.want)
+		}
+		if !prefix.Contains(got) {
+			t.Errorf("nat64SourceAddress(%s, %s) = %s, which is outside the prefix", test.prefix, test.client, got)
+		}
+	}
+}
+
+func TestParseNAT46Prefix(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+		err  string
+	}{
+		{arg: "64:ff9b::/96", want: "64:ff9b::"},
+		{arg: "64:ff9b::", want: "64:ff9b::"},
+		{arg: "2001:db8:ffff:ffff:ffff:ffff::/96", want: "2001:db8:ffff:ffff:ffff:ffff::"},
+		{arg: "::/96", want: "::"},
+		{arg: "64:ff9b::/64", err: "prefix length must be /96 so that it leaves 32 bits for the IPv4 address"},
+		{arg: "64:ff9b::/128", err: "prefix length must be /96 so that it leaves 32 bits for the IPv4 address"},
+		{arg: "::/0", err: "prefix length must be /96 so that it leaves 32 bits for the IPv4 address"},
+		{arg: "192.0.2.0/24", err: "prefix length must be /96 so that it leaves 32 bits for the IPv4 address"},
+		{arg: "192.0.2.0", err: "not an IPv6 address"},
+		{arg: "::ffff:0:0/96", err: "not an IPv6 address"},
+		{arg: "::ffff:0.0.0.0", err: "not an IPv6 address"},
+		{arg: "64:ff9b::c000:201/96", err: "lower 32 bits must be zero because they are replaced with the client's IPv4 address (did you mean 64:ff9b::?)"},
+		{arg: "64:ff9b::1", err: "lower 32 bits must be zero because they are replaced with the client's IPv4 address (did you mean 64:ff9b::?)"},
+		{arg: "64:ff9b::zz", err: "not a valid IP address"},
+	}
+	for _, test := range tests {
+		got, err := parseNAT46Prefix(test.arg)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseNAT46Prefix(%q) error = %v, want %q", test.arg, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNAT46Prefix(%q): %s", test.arg, err)
+		} else if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("parseNAT46Prefix(%q) = %s, want %s", test.arg, got, test.want)
+		}
+	}
+}
+
+func TestNAT46SourceAddress(t *testing.T) {
+	prefix := net.ParseIP("64:ff9b::")
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{"0.0.0.0", "64:ff9b::"},
+		{"192.0.2.1", "64:ff9b::c000:201"},
+		{"255.255.255.255", "64:ff9b::ffff:ffff"},
+		{"::ffff:192.0.2.1", "64:ff9b::c000:201"},
+	}
+	for _, test := range tests {
+		got := nat46SourceAddress(prefix, net.ParseIP(test.client))
+		if !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("nat46SourceAddress(%s, %s) = %s, want %s", prefix, test.client, got, test.want)
+		}
+	}
+	if !prefix.Equal(net.ParseIP("64:ff9b::")) {
+		t.Errorf("nat46SourceAddress modified the prefix to %s", prefix)
+	}
+}
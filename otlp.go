@@ -0,0 +1,265 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// otlpTimeout limits each push to an OpenTelemetry collector, so that a
+// hung collector can't stall exporting forever
+const otlpTimeout = 10 * time.Second
+
+// OTLPExporter periodically pushes the metrics gathered from a Prometheus
+// registry to an OpenTelemetry collector, using OTLP/HTTP with JSON encoding
+type OTLPExporter struct {
+	Endpoint string // e.g. http://localhost:4318/v1/metrics
+	Interval time.Duration
+	Gatherer prometheus.Gatherer
+
+	startTime time.Time
+}
+
+func (exporter *OTLPExporter) Run() {
+	exporter.startTime = time.Now()
+	ticker := time.NewTicker(exporter.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := exporter.Export(); err != nil {
+			log.Printf("Error exporting metrics to %s: %s", exporter.Endpoint, err)
+		}
+	}
+}
+
+func (exporter *OTLPExporter) Export() error {
+	families, err := exporter.Gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(exporter.makeRequest(families, time.Now()))
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: otlpTimeout}
+	resp, err := client.Post(exporter.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// The following types are the JSON encoding of the OTLP protobuf messages.
+// Note that 64-bit integers are encoded as strings.
+
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue holds exactly one of its fields, since AnyValue is a oneof
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+func otlpString(value string) otlpAnyValue {
+	return otlpAnyValue{StringValue: &value}
+}
+
+func otlpInt(value uint64) otlpAnyValue {
+	return otlpAnyValue{IntValue: strconv.FormatUint(value, 10)}
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+}
+
+const otlpCumulative = 2 // AGGREGATION_TEMPORALITY_CUMULATIVE
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	Count             string          `json:"count"`
+	Sum               float64         `json:"sum"`
+	BucketCounts      []string        `json:"bucketCounts"`
+	ExplicitBounds    []float64       `json:"explicitBounds"`
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpAttributes(labels []*dto.LabelPair) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(labels))
+	for _, label := range labels {
+		attributes = append(attributes, otlpAttribute{Key: label.GetName(), Value: otlpString(label.GetValue())})
+	}
+	return attributes
+}
+
+func (exporter *OTLPExporter) makeRequest(families []*dto.MetricFamily, now time.Time) *otlpRequest {
+	startTime, nowTime := otlpTime(exporter.startTime), otlpTime(now)
+
+	var metrics []otlpMetric
+	for _, family := range families {
+		metric := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			for _, m := range family.GetMetric() {
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberDataPoint{
+					Attributes:        otlpAttributes(m.GetLabel()),
+					StartTimeUnixNano: startTime,
+					TimeUnixNano:      nowTime,
+					AsDouble:          m.GetCounter().GetValue(),
+				})
+			}
+		case dto.MetricType_GAUGE:
+			metric.Gauge = &otlpGauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if math.IsNaN(value) {
+					// Not representable in JSON
+					continue
+				}
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpNumberDataPoint{
+					Attributes:   otlpAttributes(m.GetLabel()),
+					TimeUnixNano: nowTime,
+					AsDouble:     value,
+				})
+			}
+		case dto.MetricType_HISTOGRAM:
+			metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+			for _, m := range family.GetMetric() {
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, otlpHistogramPoint(m, startTime, nowTime))
+			}
+		default:
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return &otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: otlpString("snid")}},
+			},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "snid"},
+				Metrics: metrics,
+			}},
+		}},
+	}
+}
+
+func otlpHistogramPoint(m *dto.Metric, startTime string, nowTime string) otlpHistogramDataPoint {
+	histogram := m.GetHistogram()
+	point := otlpHistogramDataPoint{
+		Attributes:        otlpAttributes(m.GetLabel()),
+		StartTimeUnixNano: startTime,
+		TimeUnixNano:      nowTime,
+		Count:             strconv.FormatUint(histogram.GetSampleCount(), 10),
+		Sum:               histogram.GetSampleSum(),
+	}
+	// Prometheus buckets are cumulative, whereas OTLP bucket counts are not,
+	// and OTLP has an implicit final bucket for values above the last bound
+	var previous uint64
+	for _, bucket := range histogram.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), +1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(bucket.GetCumulativeCount()-previous, 10))
+		previous = bucket.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(histogram.GetSampleCount()-previous, 10))
+	return point
+}
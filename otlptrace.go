@@ -0,0 +1,205 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	otlpSpanKindServer = 2 // SPAN_KIND_SERVER
+	otlpStatusOK       = 1 // STATUS_CODE_OK
+	otlpStatusError    = 2 // STATUS_CODE_ERROR
+)
+
+// OTLPTracer batches a span for every connection and periodically pushes
+// them to an OpenTelemetry collector, using OTLP/HTTP with JSON encoding.
+// A nil *OTLPTracer discards spans, but callers should check for nil
+// before building a span, so that tracing costs nothing unless it's
+// configured.
+type OTLPTracer struct {
+	Endpoint string // e.g. http://localhost:4318/v1/traces
+	Interval time.Duration
+	MaxSpans int // spans beyond this many awaiting export are dropped
+
+	mu      sync.Mutex
+	spans   []otlpSpan
+	dropped int
+}
+
+func (tracer *OTLPTracer) Record(span otlpSpan) {
+	if tracer == nil {
+		return
+	}
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	if len(tracer.spans) >= tracer.MaxSpans {
+		tracer.dropped++
+		return
+	}
+	tracer.spans = append(tracer.spans, span)
+}
+
+func (tracer *OTLPTracer) Run() {
+	ticker := time.NewTicker(tracer.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := tracer.Export(); err != nil {
+			log.Printf("Error exporting traces to %s: %s", tracer.Endpoint, err)
+		}
+	}
+}
+
+func (tracer *OTLPTracer) Export() error {
+	tracer.mu.Lock()
+	spans, dropped := tracer.spans, tracer.dropped
+	tracer.spans, tracer.dropped = nil, 0
+	tracer.mu.Unlock()
+
+	if dropped != 0 {
+		log.Printf("Dropped %d trace spans because more than %d were awaiting export", dropped, tracer.MaxSpans)
+	}
+	if len(spans) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(makeTraceRequest(spans))
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: otlpTimeout}
+	resp, err := client.Post(tracer.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// The following types are the JSON encoding of the OTLP protobuf messages
+// for traces.  Note that trace and span IDs are encoded as hex.
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func makeTraceRequest(spans []otlpSpan) *otlpTraceRequest {
+	return &otlpTraceRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{{Key: "service.name", Value: otlpString("snid")}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "snid"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newTraceID() string {
+	return randomHex(16)
+}
+
+// newConnectionSpan returns a span covering a connection from start until
+// now, in the trace outcome.traceID (or a new trace if it's empty).  Its
+// attributes match the labels of the corresponding metrics.
+func newConnectionSpan(start time.Time, serverName string, listener listenerLabels, outcome *connOutcome) otlpSpan {
+	traceID := outcome.traceID
+	if traceID == "" {
+		traceID = newTraceID()
+	}
+	span := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            randomHex(8),
+		Name:              "connection",
+		Kind:              otlpSpanKindServer,
+		StartTimeUnixNano: otlpTime(start),
+		EndTimeUnixNano:   otlpTime(time.Now()),
+		Attributes: []otlpAttribute{
+			{Key: "server_name", Value: otlpString(serverName)},
+			{Key: "listener", Value: otlpString(listener.name)},
+			{Key: "family", Value: otlpString(listener.family)},
+		},
+		Status: otlpStatus{Code: otlpStatusOK},
+	}
+	if conn := outcome.backendConn; conn != nil {
+		span.Attributes = append(span.Attributes,
+			otlpAttribute{Key: "backend", Value: otlpString(conn.backend)},
+			otlpAttribute{Key: "bytes_from_client", Value: otlpInt(conn.bytesWritten.Load())},
+			otlpAttribute{Key: "bytes_from_backend", Value: otlpInt(conn.bytesRead.Load())},
+		)
+	}
+	if outcome.err != nil {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: "error", Value: otlpString(errorLabelValue(outcome.err))})
+		span.Status = otlpStatus{Code: otlpStatusError, Message: outcome.err.Error()}
+	}
+	return span
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errPeekMemoryExhausted = errors.New("too many bytes are buffered by connections whose ClientHello is being read")
+
+// PeekBudget caps the total number of bytes buffered by all connections
+// whose ClientHello is being read, so that a flood of slow handshakes
+// can't exhaust memory
+type PeekBudget struct {
+	Max   int64
+	Gauge prometheus.Gauge // if non-nil, set to the number of bytes in use
+
+	used atomic.Int64
+}
+
+// Exhausted reports whether no bytes are left in the budget
+func (budget *PeekBudget) Exhausted() bool {
+	return budget != nil && budget.used.Load() >= budget.Max
+}
+
+// Acquire takes n bytes from the budget, returning false without taking
+// any if fewer than n are left
+func (budget *PeekBudget) Acquire(n int64) bool {
+	for {
+		used := budget.used.Load()
+		if used+n > budget.Max {
+			return false
+		}
+		if budget.used.CompareAndSwap(used, used+n) {
+			budget.updateGauge()
+			return true
+		}
+	}
+}
+
+// Release returns n bytes to the budget
+func (budget *PeekBudget) Release(n int64) {
+	budget.used.Add(-n)
+	budget.updateGauge()
+}
+
+func (budget *PeekBudget) updateGauge() {
+	if budget.Gauge != nil {
+		budget.Gauge.Set(float64(budget.used.Load()))
+	}
+}
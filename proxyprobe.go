@@ -0,0 +1,87 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	proxyProbeInterval = time.Minute
+	proxyProbeWait     = 2 * time.Second
+)
+
+var errProxyProbeRejected = errors.New("backend closed the connection after receiving the PROXY header")
+
+// probeProxyProtocol opens a connection to the backend of hostname and
+// sends it the configured preamble and PROXY header.  A backend which
+// understands the header waits for the ClientHello; one which doesn't
+// typically responds with an alert or closes the connection, which is
+// reported as errProxyProbeRejected.
+func (server *Server) probeProxyProtocol(hostname string, clientConn ClientConn) error {
+	conn, err := server.Backend.Dial(hostname, nil, clientConn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(slices.Concat(server.backendPreamble(hostname), server.backendProxyHeader(hostname, clientConn, nil))); err != nil {
+		return errProxyProbeRejected
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(proxyProbeWait)); err != nil {
+		return err
+	}
+	if _, err := conn.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil
+	}
+	return errProxyProbeRejected
+}
+
+// runProxyProtoProbe periodically probes the backend of hostname with
+// probeProxyProtocol, marking snid as not ready while the backend rejects
+// the PROXY header.  Failures to reach the backend at all don't change
+// readiness, since they say nothing about the PROXY header.
+func runProxyProtoProbe(server *Server, hostname string, clientConn ClientConn, readiness *Readiness) {
+	for {
+		err := server.probeProxyProtocol(hostname, clientConn)
+		switch {
+		case err == nil:
+			if readiness.SetProxyMismatch(false) {
+				log.Printf("PROXY protocol probe of %s succeeded", hostname)
+			}
+		case errors.Is(err, errProxyProbeRejected):
+			readiness.SetProxyMismatch(true)
+			log.Printf("PROXY protocol probe of %s failed: %s; check that -proxy-proto and -backend-proxy-proto match the backend's configuration", hostname, err)
+		default:
+			log.Printf("PROXY protocol probe of %s could not reach the backend: %s", hostname, err)
+		}
+		time.Sleep(proxyProbeInterval)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Inbound PROXY protocol v2 parsing, and construction of outbound PROXY
+// v2 headers which carry TLVs from the inbound header
+
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+const (
+	proxyV2CommandLocal = 0x20
+	proxyV2CommandProxy = 0x21
+
+	proxyV2FamilyUnspec = 0x00
+	proxyV2FamilyTCP4   = 0x11
+	proxyV2FamilyTCP6   = 0x21
+)
+
+// proxyV2AddressLens is the length of the address block for each address
+// family (the high nibble of the family byte), regardless of transport
+var proxyV2AddressLens = map[byte]int{
+	0x1: 12,  // AF_INET
+	0x2: 36,  // AF_INET6
+	0x3: 216, // AF_UNIX
+}
+
+// PROXY v2 TLV types recognized by -proxy-tlv
+var proxyTLVTypes = map[string]byte{
+	"alpn":      0x01,
+	"authority": 0x02,
+	"crc32c":    0x03,
+	"unique-id": 0x05,
+	"ssl":       0x20,
+	"netns":     0x30,
+}
+
+const proxyTLVTypeCRC32C = 0x03
+
+type proxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// proxyHeader is an inbound PROXY header.  The addresses are nil if the
+// header doesn't contain TCP addresses (e.g. for the LOCAL command).
+type proxyHeader struct {
+	RemoteAddr *net.TCPAddr
+	LocalAddr  *net.TCPAddr
+	TLVs       []proxyTLV
+}
+
+// readProxyHeader reads a PROXY v2 header from r, without reading any
+// further.  If the header has a CRC32C TLV, the checksum is verified.
+func readProxyHeader(r io.Reader) (*proxyHeader, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	if string(fixed[:12]) != proxyV2Signature {
+		return nil, errors.New("not a PROXY v2 header")
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY version %d", fixed[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	header := new(proxyHeader)
+	addressLen := proxyV2AddressLens[fixed[13]>>4]
+	if len(body) < addressLen {
+		return nil, errors.New("PROXY header is too short for its addresses")
+	}
+	isTCP := fixed[13] == proxyV2FamilyTCP4 || fixed[13] == proxyV2FamilyTCP6
+	if fixed[12] == proxyV2CommandProxy && isTCP {
+		ipLen := (addressLen - 4) / 2
+		header.RemoteAddr = &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(body[:ipLen])),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+		}
+		header.LocalAddr = &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(body[ipLen : 2*ipLen])),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+		}
+	}
+
+	crcOffset := -1
+	tlvs := body[addressLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, errors.New("truncated PROXY TLV")
+		}
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, errors.New("truncated PROXY TLV")
+		}
+		if tlvs[0] == proxyTLVTypeCRC32C {
+			if length != 4 {
+				return nil, errors.New("PROXY CRC32C TLV has the wrong length")
+			}
+			crcOffset = len(body) - len(tlvs) + 3
+		}
+		header.TLVs = append(header.TLVs, proxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+length]})
+		tlvs = tlvs[3+length:]
+	}
+	if crcOffset != -1 && !checkProxyCRC32C(fixed[:], body, crcOffset) {
+		return nil, errors.New("PROXY header has the wrong CRC32C checksum")
+	}
+	return header, nil
+}
+
+// checkProxyCRC32C returns whether the CRC32C TLV value at crcOffset in
+// body is the checksum of the whole header, computed with the value
+// zeroed
+func checkProxyCRC32C(fixed []byte, body []byte, crcOffset int) bool {
+	want := binary.BigEndian.Uint32(body[crcOffset:])
+	table := crc32.MakeTable(crc32.Castagnoli)
+	crc := crc32.Update(0, table, fixed)
+	crc = crc32.Update(crc, table, body[:crcOffset])
+	crc = crc32.Update(crc, table, []byte{0, 0, 0, 0})
+	crc = crc32.Update(crc, table, body[crcOffset+4:])
+	return crc == want
+}
+
+// filterTLVs returns the TLVs in header whose types are in allowed.
+// header may be nil.
+func (header *proxyHeader) filterTLVs(allowed []byte) []proxyTLV {
+	if header == nil {
+		return nil
+	}
+	var tlvs []proxyTLV
+	for _, tlv := range header.TLVs {
+		if bytes.IndexByte(allowed, tlv.Type) != -1 {
+			tlvs = append(tlvs, tlv)
+		}
+	}
+	return tlvs
+}
+
+// formatProxyHeader returns a PROXY v2 header with the given addresses and
+// TLVs.  If the addresses aren't both TCP addresses of the same family, the
+// LOCAL command is used.  A CRC32C TLV is recomputed for the new header.
+func formatProxyHeader(remoteAddr net.Addr, localAddr net.Addr, tlvs []proxyTLV) []byte {
+	header := []byte(proxyV2Signature)
+	command, family := byte(proxyV2CommandLocal), byte(proxyV2FamilyUnspec)
+	var addresses []byte
+	remoteTCPAddr, remoteIsTCP := remoteAddr.(*net.TCPAddr)
+	localTCPAddr, localIsTCP := localAddr.(*net.TCPAddr)
+	if remoteIsTCP && localIsTCP {
+		if remoteIP, localIP := remoteTCPAddr.IP.To4(), localTCPAddr.IP.To4(); remoteIP != nil && localIP != nil {
+			command, family = proxyV2CommandProxy, proxyV2FamilyTCP4
+			addresses = append(append(addresses, remoteIP...), localIP...)
+		} else if remoteIP, localIP := remoteTCPAddr.IP.To16(), localTCPAddr.IP.To16(); remoteIP != nil && localIP != nil {
+			command, family = proxyV2CommandProxy, proxyV2FamilyTCP6
+			addresses = append(append(addresses, remoteIP...), localIP...)
+		}
+		if command == proxyV2CommandProxy {
+			addresses = binary.BigEndian.AppendUint16(addresses, uint16(remoteTCPAddr.Port))
+			addresses = binary.BigEndian.AppendUint16(addresses, uint16(localTCPAddr.Port))
+		}
+	}
+
+	body := addresses
+	crcOffset := -1
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type)
+		if tlv.Type == proxyTLVTypeCRC32C {
+			body = binary.BigEndian.AppendUint16(body, 4)
+			crcOffset = len(header) + 4 + len(body)
+			body = append(body, 0, 0, 0, 0)
+		} else {
+			body = binary.BigEndian.AppendUint16(body, uint16(len(tlv.Value)))
+			body = append(body, tlv.Value...)
+		}
+	}
+
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	header = append(header, body...)
+	if crcOffset != -1 {
+		crc := crc32.Checksum(header, crc32.MakeTable(crc32.Castagnoli))
+		binary.BigEndian.PutUint32(header[crcOffset:], crc)
+	}
+	return header
+}
+
+// formatProxyHeaderV1 returns a human-readable PROXY v1 header with the
+// given addresses, or an UNKNOWN header if they aren't both TCP addresses
+// of the same family
+func formatProxyHeaderV1(remoteAddr net.Addr, localAddr net.Addr) []byte {
+	remoteTCPAddr, remoteIsTCP := remoteAddr.(*net.TCPAddr)
+	localTCPAddr, localIsTCP := localAddr.(*net.TCPAddr)
+	if !remoteIsTCP || !localIsTCP {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	remoteIs4, localIs4 := remoteTCPAddr.IP.To4() != nil, localTCPAddr.IP.To4() != nil
+	if remoteIs4 != localIs4 {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP6"
+	if remoteIs4 {
+		family = "TCP4"
+	}
+	return fmt.Appendf(nil, "PROXY %s %s %s %d %d\r\n", family, remoteTCPAddr.IP, localTCPAddr.IP, remoteTCPAddr.Port, localTCPAddr.Port)
+}
+
+// parseProxyVersion parses a per-backend PROXY protocol setting
+func parseProxyVersion(arg string) (string, error) {
+	switch arg {
+	case "none", "v1", "v2":
+		return arg, nil
+	default:
+		return "", fmt.Errorf("PROXY protocol version must be none, v1, or v2")
+	}
+}
+
+// proxiedConn overrides the addresses of a client connection with the
+// addresses from its inbound PROXY header
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (conn *proxiedConn) RemoteAddr() net.Addr { return conn.remoteAddr }
+func (conn *proxiedConn) LocalAddr() net.Addr  { return conn.localAddr }
+
+func parseProxyTLVType(arg string) (byte, error) {
+	if tlvType, ok := proxyTLVTypes[arg]; ok {
+		return tlvType, nil
+	}
+	tlvType, err := strconv.ParseUint(arg, 0, 8)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a known TLV name or a number between 0 and 255", arg)
+	}
+	return byte(tlvType), nil
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	ptrLookupTimeout = 2 * time.Second
+	ptrCacheTTL      = 5 * time.Minute  // for definitive answers
+	ptrFailureTTL    = 10 * time.Second // for lookups which failed transiently
+)
+
+var errPTRMismatch = errors.New("backend's reverse DNS does not match -backend-ptr-suffix")
+
+// PTRChecker checks that the PTR records of backend addresses match one
+// of a set of suffixes, caching the result for each address
+type PTRChecker struct {
+	Suffixes *SuffixSet
+	Resolver *net.Resolver
+
+	mu        sync.Mutex
+	cache     map[netip.Addr]ptrCacheEntry
+	lastSweep time.Time
+}
+
+type ptrCacheEntry struct {
+	err     error
+	expires time.Time
+}
+
+// Check returns nil if one of the PTR records of the IP address in
+// address (of the form IP:PORT) matches Suffixes, and otherwise an error
+// wrapping errPTRMismatch.  A failed lookup counts as a mismatch, but
+// unless the address has no PTR records, it's only cached briefly, so
+// that a transient DNS failure doesn't block a healthy backend for long.
+func (checker *PTRChecker) Check(address string) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	now := time.Now()
+
+	checker.mu.Lock()
+	entry, ok := checker.cache[ip]
+	checker.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.err
+	}
+
+	definitive, err := checker.lookup(ip)
+	ttl := ptrCacheTTL
+	if !definitive {
+		ttl = ptrFailureTTL
+	}
+	checker.mu.Lock()
+	defer checker.mu.Unlock()
+	if checker.cache == nil {
+		checker.cache = make(map[netip.Addr]ptrCacheEntry)
+	}
+	// Expired entries are replaced when their address is checked again;
+	// sweep the rest out occasionally so that the cache doesn't grow
+	// without bound
+	if now.Sub(checker.lastSweep) > ptrCacheTTL {
+		for cachedIP, cached := range checker.cache {
+			if now.After(cached.expires) {
+				delete(checker.cache, cachedIP)
+			}
+		}
+		checker.lastSweep = now
+	}
+	checker.cache[ip] = ptrCacheEntry{err: err, expires: now.Add(ttl)}
+	return err
+}
+
+// lookup checks the PTR records of ip, and returns whether the result is
+// definitive, i.e. not caused by a transient lookup failure
+func (checker *PTRChecker) lookup(ip netip.Addr) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ptrLookupTimeout)
+	defer cancel()
+	names, err := checker.Resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		var dnsErr *net.DNSError
+		definitive := errors.As(err, &dnsErr) && dnsErr.IsNotFound
+		return definitive, fmt.Errorf("%w: looking up PTR record of %s: %w", errPTRMismatch, ip, err)
+	}
+	for _, name := range names {
+		if checker.Suffixes.Contains(name) {
+			return true, nil
+		}
+	}
+	return true, fmt.Errorf("%w: PTR records of %s are %q", errPTRMismatch, ip, names)
+}
@@ -0,0 +1,65 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// PushgatewayExporter periodically pushes the metrics gathered from a
+// Prometheus registry to a Prometheus pushgateway, for instances which
+// can't be scraped
+type PushgatewayExporter struct {
+	URL      string // e.g. http://localhost:9091
+	Job      string
+	Grouping map[string]string // additional grouping labels, e.g. instance
+	Interval time.Duration
+	Gatherer prometheus.Gatherer
+}
+
+func (exporter *PushgatewayExporter) Run() {
+	ticker := time.NewTicker(exporter.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := exporter.Push(); err != nil {
+			log.Printf("Error pushing metrics to %s: %s", exporter.URL, err)
+		}
+	}
+}
+
+// Push replaces the metrics in the pushgateway for this job and grouping
+// with the current metrics
+func (exporter *PushgatewayExporter) Push() error {
+	pusher := push.New(exporter.URL, exporter.Job).Gatherer(exporter.Gatherer)
+	for name, value := range exporter.Grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	return pusher.Push()
+}
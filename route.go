@@ -0,0 +1,241 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Route struct {
+	// Backend address, as "host" or "host:port".  If the port is
+	// omitted, the usual port selection rules apply.
+	Backend string
+
+	// If non-zero, override the global timeouts for connecting to
+	// the backend, and for closing idle connections
+	DialTimeout time.Duration
+	IdleTimeout time.Duration
+
+	// Backends to use instead of Backend for clients whose highest
+	// offered TLS version is within a range.  The first match wins.
+	TLSVersionBackends []TLSVersionBackend
+}
+
+type TLSVersionBackend struct {
+	MinVersion uint16 // inclusive
+	MaxVersion uint16 // inclusive
+	Backend    string
+}
+
+// backendForTLSVersion returns the backend address for a client whose
+// highest offered TLS version is version
+func (route *Route) backendForTLSVersion(version uint16) string {
+	for _, versionBackend := range route.TLSVersionBackends {
+		if versionBackend.MinVersion <= version && version <= versionBackend.MaxVersion {
+			return versionBackend.Backend
+		}
+	}
+	return route.Backend
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersionBackend parses VERSIONS:BACKEND, where VERSIONS is a TLS
+// version (e.g. 1.3) or a range of them (e.g. 1.0-1.2, or 1.2- for 1.2
+// and above)
+func parseTLSVersionBackend(value string) (TLSVersionBackend, error) {
+	versions, backend, ok := strings.Cut(value, ":")
+	if !ok {
+		return TLSVersionBackend{}, fmt.Errorf("must be of the form VERSIONS:BACKEND")
+	}
+	minString, maxString, isRange := strings.Cut(versions, "-")
+	if !isRange {
+		maxString = minString
+	}
+	versionBackend := TLSVersionBackend{MinVersion: 0, MaxVersion: 0xffff}
+	if minString != "" {
+		if versionBackend.MinVersion, ok = tlsVersions[minString]; !ok {
+			return TLSVersionBackend{}, fmt.Errorf("unknown TLS version %q", minString)
+		}
+	}
+	if maxString != "" {
+		if versionBackend.MaxVersion, ok = tlsVersions[maxString]; !ok {
+			return TLSVersionBackend{}, fmt.Errorf("unknown TLS version %q", maxString)
+		}
+	}
+	if versionBackend.MinVersion > versionBackend.MaxVersion {
+		return TLSVersionBackend{}, fmt.Errorf("TLS version range %q is empty", versions)
+	}
+	var err error
+	if versionBackend.Backend, err = parseRouteBackend(backend); err != nil {
+		return TLSVersionBackend{}, err
+	}
+	return versionBackend, nil
+}
+
+type RouteTable struct {
+	mu         sync.RWMutex
+	routes     map[string]*Route
+	generation uint64 // incremented whenever routes change
+
+	// Number of established connections by the generation they were
+	// routed under (see Pin)
+	pinnedMu sync.Mutex
+	pinned   map[uint64]int
+
+	// If non-nil, set to the number of connections pinned to each
+	// generation, labeled by generation
+	PinnedGauge *prometheus.GaugeVec
+}
+
+func NewRouteTable() *RouteTable {
+	return &RouteTable{routes: make(map[string]*Route), pinned: make(map[uint64]int)}
+}
+
+// Lookup returns the route for hostname, falling back to the wildcard
+// route for hostname, or nil if neither exist (or table is nil)
+func (table *RouteTable) Lookup(origHostname string) *Route {
+	if table == nil {
+		return nil
+	}
+	hostname, err := canonicalizeHostname(origHostname)
+	if err != nil {
+		return nil
+	}
+
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	if route, ok := table.routes[hostname]; ok {
+		return route
+	}
+	return table.routes[wildcardHostname(hostname)]
+}
+
+// All returns a copy of the routes in table (which may be nil)
+func (table *RouteTable) All() map[string]*Route {
+	if table == nil {
+		return nil
+	}
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return maps.Clone(table.routes)
+}
+
+func (table *RouteTable) Set(hostname string, route *Route) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.routes[hostname] = route
+	table.generation++
+}
+
+// Replace replaces all the routes in table with routes
+func (table *RouteTable) Replace(routes map[string]*Route) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.routes = routes
+	table.generation++
+}
+
+func (table *RouteTable) Delete(hostname string) {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	delete(table.routes, hostname)
+	table.generation++
+}
+
+// parseRoute parses a backend address followed by options of the form
+// dial-timeout=DURATION, idle-timeout=DURATION, or tls=VERSIONS:BACKEND
+func parseRoute(fields []string) (*Route, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("backend address is empty")
+	}
+	backend, err := parseRouteBackend(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	route := &Route{Backend: backend}
+	for _, option := range fields[1:] {
+		name, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return nil, fmt.Errorf("option %q must be of the form NAME=VALUE", option)
+		}
+		var timeout *time.Duration
+		switch name {
+		case "tls":
+			versionBackend, err := parseTLSVersionBackend(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			route.TLSVersionBackends = append(route.TLSVersionBackends, versionBackend)
+			continue
+		case "dial-timeout":
+			timeout = &route.DialTimeout
+		case "idle-timeout":
+			timeout = &route.IdleTimeout
+		default:
+			return nil, fmt.Errorf("unknown option %q", name)
+		}
+		if *timeout, err = time.ParseDuration(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		} else if *timeout <= 0 {
+			return nil, fmt.Errorf("%s must be positive", name)
+		}
+	}
+	return route, nil
+}
+
+func parseRouteBackend(backend string) (string, error) {
+	if backend == "" {
+		return "", fmt.Errorf("backend address is empty")
+	}
+	host, port, err := net.SplitHostPort(backend)
+	if err != nil {
+		// No port; strip the brackets from an IPv6 address so that it
+		// can be joined with a port later
+		host = strings.TrimSuffix(strings.TrimPrefix(backend, "["), "]")
+		backend = host
+	} else if portno, err := strconv.ParseUint(port, 10, 16); err != nil || portno == 0 {
+		return "", fmt.Errorf("invalid port number %q", port)
+	}
+	if host == "" {
+		return "", fmt.Errorf("backend host is empty")
+	}
+	return backend, nil
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseRouteBackend(t *testing.T) {
+	tests := []struct {
+		backend string
+		want    string
+		err     bool
+	}{
+		{backend: "backend.example", want: "backend.example"},
+		{backend: "backend.example:8443", want: "backend.example:8443"},
+		{backend: "192.0.2.1", want: "192.0.2.1"},
+		{backend: "192.0.2.1:443", want: "192.0.2.1:443"},
+		{backend: "[2001:db8::1]:443", want: "[2001:db8::1]:443"},
+		{backend: "[2001:db8::1]", want: "2001:db8::1"},
+		{backend: "2001:db8::1", want: "2001:db8::1"},
+		{backend: "[fe80::1%eth0]:443", want: "[fe80::1%eth0]:443"},
+		{backend: "[fe80::1%eth0]", want: "fe80::1%eth0"},
+		{backend: "fe80::1%eth0", want: "fe80::1%eth0"},
+		{backend: "", err: true},
+		{backend: ":443", err: true},
+		{backend: "backend.example:0", err: true},
+		{backend: "backend.example:65536", err: true},
+		{backend: "[fe80::1%eth0]:https", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseRouteBackend(test.backend)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseRouteBackend(%q) = %q, want error", test.backend, got)
+			}
+		} else if err != nil {
+			t.Errorf("parseRouteBackend(%q): %s", test.backend, err)
+		} else if got != test.want {
+			t.Errorf("parseRouteBackend(%q) = %q, want %q", test.backend, got, test.want)
+		}
+	}
+}
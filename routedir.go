@@ -0,0 +1,133 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// loadRouteFile loads the route in the given file into table, where the
+// file name is the hostname and its contents are the backend address,
+// optionally followed by route options
+func loadRouteFile(table *RouteTable, path string) error {
+	hostname, err := canonicalizeHostname(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	route, err := parseRoute(strings.Fields(string(contents)))
+	if err != nil {
+		return err
+	}
+	table.Set(hostname, route)
+	return nil
+}
+
+func isRouteFileName(name string) bool {
+	// Skip hidden files, such as editor swap files and files that are
+	// being written before being atomically renamed into place
+	return !strings.HasPrefix(name, ".")
+}
+
+// WatchRouteDir loads every route file in dir into table, and then keeps
+// table up-to-date as files are created, modified, and deleted
+func WatchRouteDir(table *RouteTable, dir string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isRouteFileName(entry.Name()) {
+			continue
+		}
+		if err := loadRouteFile(table, filepath.Join(dir, entry.Name())); err != nil {
+			log.Printf("Skipping route file %s: %s", entry.Name(), err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				handleRouteDirEvent(table, event)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Error watching route directory %s: %s", dir, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func handleRouteDirEvent(table *RouteTable, event fsnotify.Event) {
+	name := filepath.Base(event.Name)
+	if !isRouteFileName(name) {
+		return
+	}
+	hostname, err := canonicalizeHostname(name)
+	if err != nil {
+		log.Printf("Skipping route file %s: %s", name, err)
+		return
+	}
+
+	switch {
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		table.Delete(hostname)
+	case event.Has(fsnotify.Create), event.Has(fsnotify.Write):
+		if err := loadRouteFile(table, event.Name); err != nil {
+			table.Delete(hostname)
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Skipping route file %s: %s", name, err)
+			}
+		}
+	}
+}
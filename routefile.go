@@ -0,0 +1,110 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"unicode"
+)
+
+// readRouteFile reads a file with one route per line, consisting of a
+// hostname, a backend address, and optional route options, separated by
+// whitespace or commas.
+// Blank lines and comments starting with # are ignored.  check, if
+// non-nil, is called to validate each route.
+func readRouteFile(path string, check func(hostname string, route *Route) error) (map[string]*Route, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	routes := make(map[string]*Route)
+	scanner := bufio.NewScanner(file)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: line must contain a hostname and a backend address", path, lineno)
+		}
+		hostname, err := canonicalizeHostname(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %q: %w", path, lineno, fields[0], err)
+		}
+		route, err := parseRoute(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+		if check != nil {
+			if err := check(hostname, route); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, lineno, err)
+			}
+		}
+		if _, exists := routes[hostname]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate route for %s", path, lineno, hostname)
+		}
+		routes[hostname] = route
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// LoadRouteFile replaces the routes in table with those in the route file
+// at path, and reloads the file whenever snid receives SIGHUP.  If
+// reloading fails, the previous routes remain in effect.
+func LoadRouteFile(table *RouteTable, path string, check func(hostname string, route *Route) error) error {
+	routes, err := readRouteFile(path, check)
+	if err != nil {
+		return err
+	}
+	table.Replace(routes)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			routes, err := readRouteFile(path, check)
+			if err != nil {
+				log.Printf("Failed to reload routes, keeping previous routes: %s", err)
+				continue
+			}
+			table.Replace(routes)
+			log.Printf("Reloaded %d routes from %s as route generation %d; established connections by route generation: %s", len(routes), path, table.Generation(), table.PinnedSummary())
+		}
+	}()
+	return nil
+}
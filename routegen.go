@@ -0,0 +1,99 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Generation returns the number of times the routes in table have changed
+func (table *RouteTable) Generation() uint64 {
+	table.mu.RLock()
+	defer table.mu.RUnlock()
+	return table.generation
+}
+
+// Pin counts an established connection to hostname against the current
+// generation of routes, if hostname has a route, and returns the
+// generation, which must be passed to Unpin once the connection closes.
+// This tracks whether connections routed before a reload are still open.
+func (table *RouteTable) Pin(hostname string) (uint64, bool) {
+	if table == nil || table.Lookup(hostname) == nil {
+		return 0, false
+	}
+	generation := table.Generation()
+	table.pinnedMu.Lock()
+	defer table.pinnedMu.Unlock()
+	table.pinned[generation]++
+	if table.PinnedGauge != nil {
+		table.PinnedGauge.WithLabelValues(strconv.FormatUint(generation, 10)).Inc()
+	}
+	return generation, true
+}
+
+// Unpin uncounts a connection counted by Pin.  Once the last connection
+// pinned to an old generation closes, that is logged, so that it's clear
+// when backends removed from the routes are no longer in use.
+func (table *RouteTable) Unpin(generation uint64) {
+	table.pinnedMu.Lock()
+	defer table.pinnedMu.Unlock()
+	table.pinned[generation]--
+	label := strconv.FormatUint(generation, 10)
+	if table.pinned[generation] != 0 {
+		if table.PinnedGauge != nil {
+			table.PinnedGauge.WithLabelValues(label).Dec()
+		}
+		return
+	}
+	delete(table.pinned, generation)
+	if table.PinnedGauge != nil {
+		table.PinnedGauge.DeleteLabelValues(label)
+	}
+	if generation != table.Generation() {
+		log.Printf("All connections routed under route generation %d have closed", generation)
+	}
+}
+
+// PinnedSummary describes the number of connections pinned to each
+// generation, oldest first, e.g. "3:12 4:1"
+func (table *RouteTable) PinnedSummary() string {
+	table.pinnedMu.Lock()
+	defer table.pinnedMu.Unlock()
+	generations := slices.Sorted(maps.Keys(table.pinned))
+	var summary []string
+	for _, generation := range generations {
+		summary = append(summary, fmt.Sprintf("%d:%d", generation, table.pinned[generation]))
+	}
+	if len(summary) == 0 {
+		return "none"
+	}
+	return strings.Join(summary, " ")
+}
@@ -26,31 +26,297 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"src.agwa.name/go-listener/proxy"
 	"src.agwa.name/go-listener/tlsutil"
 )
 
+var errNoSNI = errors.New("no SNI provided and DefaultHostname not set")
+
+const defaultHeaderTimeout = 5 * time.Second
+
+const (
+	closedByClient  = 1
+	closedByBackend = 2
+)
+
+// maxDumpedHelloBytes limits how much of a failed ClientHello is logged
+// when Server.DumpFailedHello is set
+const maxDumpedHelloBytes = 4096
+
 type Server struct {
-	Backend         BackendDialer
-	ProxyProtocol   bool
-	DefaultHostname string
+	Backend          BackendDialer
+	ListenerBackends map[string]BackendDialer // by listener address, overriding Backend
+	ProxyProtocol    bool
+	DefaultHostname  string
+	Metrics          *Metrics
+	Webhook          *Webhook
+	Tarpit           *Tarpit         // if non-nil, hold rejected connections open
+	TarpitAllDown    bool            // if true, also tarpit connections whose backend's addresses are all down
+	ResetOnError     map[string]bool // by error label or "default", whether to close failed connections with a RST
+	DialLatency      *DialLatencyReporter
+	TopHostnames     *TopHostnames // if non-nil, tracks the most requested hostnames
+	LastErrors       *LastErrors   // if non-nil, records the last error of each routed backend
+	AuditLog         *AuditLog     // if non-nil, every connection is recorded here
+	Tracer           *OTLPTracer   // if non-nil, a span is exported for every connection
+	GeoIP            *GeoIP        // if non-nil, connections are counted and logged by client country
+	PeekBudget       *PeekBudget   // if non-nil, caps the bytes buffered while reading ClientHellos
+	Readiness        *Readiness    // if non-nil, connections are closed as soon as they're accepted while it's warming
+
+	// If non-nil, hostnames whose backends must not be dialed
+	DrainedBackends *DrainedBackends
+
+	// If non-nil, limits concurrent connections from each client IP
+	// address (the address from the PROXY header with AcceptProxyProtocol)
+	ClientConnLimit *ClientConnLimit
+
+	// If true, clients must send a PROXY v2 header, whose addresses
+	// replace the client connection's addresses, and whose TLVs with
+	// types in ProxyTLVs are passed on in the PROXY header sent to the
+	// backend
+	AcceptProxyProtocol bool
+	ProxyTLVs           []byte
+
+	// If non-empty, only read a PROXY header from clients whose address
+	// is within one of these CIDRs (or which connect over a UNIX
+	// socket); other clients are handled as if AcceptProxyProtocol
+	// were false
+	TrustedProxyCIDRs []*net.IPNet
+
+	// If ProxyProtocol is true, the PROXY protocol version (none, v1,
+	// or v2) to use for particular hostnames or wildcard hostnames,
+	// instead of v2
+	BackendProxyVersions map[string]string
+
+	// Bytes to write to the backend of particular hostnames or wildcard
+	// hostnames after connecting, before the PROXY header and the
+	// ClientHello
+	BackendPreambles map[string][]byte
+
+	// If non-empty, connections whose SNI hostname is an IP address
+	// (which RFC 6066 forbids) are routed to this hostname instead of
+	// being rejected
+	IPLiteralSNIHostname string
+
+	// If true, log the addresses of both the client and backend
+	// connections of each proxied connection, for correlation with
+	// conntrack
+	LogFlows bool
+
+	// Which connections to log when they close: LogConnectionsAll,
+	// LogConnectionsErrors (the default if empty), or LogConnectionsNone
+	LogConnections string
+
+	// If non-zero, only log this fraction (between 0 and 1) of failed
+	// connections, chosen at random.  Every failure is still counted
+	// in the metrics.
+	RejectLogSampleRate float64
+
+	// If true, reject ClientHellos which offer no cipher suites (other
+	// than GREASE values), rather than just counting them
+	RejectBogusHello bool
+
+	// If non-zero, reject ClientHellos whose highest offered TLS version
+	// is lower than this
+	MinTLSVersion uint16
+
+	// If true, don't proxy connections; instead log and count the
+	// backend that each would be routed to, and close it.  The Backend
+	// must be configured to observe rather than connect (see
+	// TCPDialer.Observe and UnixDialer.Observe).
+	ObserveOnly bool
+
+	// If true, an SNI hostname with a :port suffix (which is invalid,
+	// but sent by some clients) is routed using the hostname and the port
+	LenientSNIPort bool
+
+	// If true, reject SNI hostnames which aren't syntactically valid
+	// DNS hostnames with at least two labels (or one label, if
+	// AllowSingleLabelSNI is true)
+	RequireFQDN         bool
+	AllowSingleLabelSNI bool
+
+	// If non-nil, SNI hostnames which match a suffix in DeniedSNI, or
+	// which don't match a suffix in AllowedSNI, are rejected
+	AllowedSNI *SuffixSet
+	DeniedSNI  *SuffixSet
+
+	// If true, reject clients which don't offer any ALPN protocols
+	RequireALPN bool
+
+	// If true, SNI hostnames are converted to their ASCII (punycode)
+	// form before routing, and connections with invalid internationalized
+	// hostnames are rejected
+	NormalizeIDN bool
+
+	// If non-empty, connections whose first PSK identity starts with
+	// this prefix are routed to the hostname in the rest of the identity
+	// instead of the SNI hostname
+	PSKRoutePrefix string
+
+	// If true, log a hex dump of the bytes received from the client when
+	// the ClientHello can't be parsed, for debugging
+	DumpFailedHello bool
+
+	// Fraction of connections (between 0 and 1) for which to log the
+	// timing of each phase
+	TraceSampleRate float64
+
+	// Maximum time to wait for the client to send its first byte, and
+	// to send the complete ClientHello (defaults to 5 seconds)
+	FirstByteTimeout time.Duration
+	HeaderTimeout    time.Duration
+
+	// How long to wait after the client finishes sending before
+	// half-closing the backend connection
+	CloseWriteDelay time.Duration
+
+	// If non-zero, close connections which transfer no data in either
+	// direction for this long.  Routes with an IdleTimeout override it.
+	IdleTimeout time.Duration
+
+	// If non-zero, close connections this long after the backend is
+	// connected
+	MaxLifetime time.Duration
+
+	// If non-zero, the type of a ClientHello extension containing the
+	// maximum lifetime of the connection, which overrides MaxLifetime but
+	// is capped at LifetimeExtensionCap
+	LifetimeExtension    uint16
+	LifetimeExtensionCap time.Duration
+
+	// Routes, if non-nil, are consulted for per-route settings such as
+	// IdleTimeout
+	Routes *RouteTable
+
+	// If true, never half-close the backend connection; instead, wait
+	// for the backend to close the connection
+	DisableHalfClose bool
+
+	// If true, fully close UNIX domain socket backend connections,
+	// instead of half-closing them, when the client finishes sending
+	UnixFullClose bool
+
+	// If true, disable TCP_NODELAY on TCP client and backend connections,
+	// so that small writes are batched; otherwise, ensure it is enabled
+	DisableNoDelay bool
+
+	// If non-zero, close connections which transfer more than this many
+	// bytes, in each direction if MaxBytesPerDirection is true, or in
+	// total otherwise
+	MaxBytes             uint64
+	MaxBytesPerDirection bool
+
+	// If non-zero, stop accepting connections while this many are
+	// being handled
+	MaxHandlers int
+
+	handlerSlotsOnce sync.Once
+	handlerSlots     chan struct{}
+
+	draining atomic.Bool
 }
 
-func (server *Server) peekClientHello(clientConn net.Conn) (*tls.ClientHelloInfo, net.Conn, error) {
-	if err := clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-		return nil, nil, err
+// peekConn extends the read deadline to headerDeadline once the client
+// sends its first byte.  It saves the bytes which are read in recorded, so
+// that they can be replayed to the backend.
+type peekConn struct {
+	net.Conn
+	headerDeadline time.Time
+	gotFirstByte   bool
+	recorded       []byte
+
+	// If budget is non-nil, the recorded bytes are charged to it
+	budget    *PeekBudget
+	charged   int64
+	exhausted bool
+
+	// The error returned by Conn, if any, as opposed to an error from
+	// parsing what was read
+	readErr error
+}
+
+func (conn *peekConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	if err != nil {
+		conn.readErr = err
 	}
+	if conn.budget != nil && n > 0 {
+		if !conn.budget.Acquire(int64(n)) {
+			conn.exhausted = true
+			return 0, errPeekMemoryExhausted
+		}
+		conn.charged += int64(n)
+	}
+	conn.recorded = append(conn.recorded, p[:n]...)
+	if n > 0 && !conn.gotFirstByte {
+		conn.gotFirstByte = true
+		if err := conn.Conn.SetReadDeadline(conn.headerDeadline); err != nil {
+			conn.readErr = err
+			return n, err
+		}
+	}
+	return n, err
+}
 
-	clientHello, peekedClientConn, err := tlsutil.PeekClientHelloFromConn(clientConn)
+// peekClientHello reads the ClientHello from clientConn, and returns it
+// along with the bytes which were read, which must be sent to the backend
+// before the rest of the client's data
+func (server *Server) peekClientHello(clientConn net.Conn, listener listenerLabels) (*tls.ClientHelloInfo, []byte, error) {
+	start := time.Now()
+	headerTimeout := server.HeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = defaultHeaderTimeout
+	}
+	if server.PeekBudget.Exhausted() {
+		return nil, nil, errPeekMemoryExhausted
+	}
+	conn := &peekConn{Conn: clientConn, headerDeadline: start.Add(headerTimeout), budget: server.PeekBudget}
+	if conn.budget != nil {
+		defer func() { conn.budget.Release(conn.charged) }()
+	}
+	firstByteTimeout := server.FirstByteTimeout != 0 && server.FirstByteTimeout < headerTimeout
+	if firstByteTimeout {
+		if err := clientConn.SetReadDeadline(start.Add(server.FirstByteTimeout)); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if err := clientConn.SetReadDeadline(conn.headerDeadline); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	clientHello, _, err := tlsutil.PeekClientHelloFromConn(conn)
 	if err != nil {
+		if conn.exhausted {
+			return nil, nil, errPeekMemoryExhausted
+		}
+		if firstByteTimeout && !conn.gotFirstByte && isTimeout(err) {
+			return nil, nil, fmt.Errorf("%w: %w", errFirstByteTimeout, err)
+		}
+		if conn.readErr == nil {
+			// The client sent something which crypto/tls rejected,
+			// rather than the connection failing
+			err = fmt.Errorf("%w: %w", errInvalidHello, err)
+		}
+		if server.DumpFailedHello && !errors.Is(err, io.EOF) && !isTimeout(err) {
+			dump := conn.recorded[:min(len(conn.recorded), maxDumpedHelloBytes)]
+			log.Printf("Failed to parse ClientHello from %s (%s); first %d of %d bytes received:\n%s", clientConn.RemoteAddr(), err, len(dump), len(conn.recorded), hex.Dump(dump))
+		}
 		return nil, nil, err
 	}
 
@@ -58,66 +324,586 @@ func (server *Server) peekClientHello(clientConn net.Conn) (*tls.ClientHelloInfo
 		return nil, nil, err
 	}
 
+	// Count ECH before any policy can reject the ClientHello, so that
+	// rejected ECH clients are counted too
+	if offersECH(clientHello) {
+		listener.metrics.echHandshakes.Inc()
+	}
+
+	if server.PSKRoutePrefix != "" {
+		if hostname, ok := pskRouteHostname(conn.recorded, server.PSKRoutePrefix); ok {
+			clientHello.ServerName = hostname
+		}
+	}
+
 	if clientHello.ServerName == "" {
 		if server.DefaultHostname == "" {
-			return nil, nil, errors.New("no SNI provided and DefaultHostname not set")
+			return nil, nil, errNoSNI
 		}
 		clientHello.ServerName = server.DefaultHostname
 	}
 
-	return clientHello, peekedClientConn, err
+	return clientHello, conn.recorded, nil
 }
 
-func (server *Server) handleConnection(clientConn net.Conn) {
-	defer func() { clientConn.Close() }()
+// pskRouteHostname returns the hostname following prefix in the first PSK
+// identity of the ClientHello contained in rawClientHello
+func pskRouteHostname(rawClientHello []byte, prefix string) (string, bool) {
+	identities := pskIdentities(rawClientHello)
+	if len(identities) == 0 {
+		return "", false
+	}
+	hostname, ok := strings.CutPrefix(string(identities[0]), prefix)
+	return hostname, ok && hostname != ""
+}
+
+// dialClientConn is the ClientConn passed to the BackendDialer.  It
+// carries the labels of the listener which accepted the connection, and
+// the backend port from the client's SNI hostname, if any.
+type dialClientConn struct {
+	ClientConn
+	listener   listenerLabels
+	port       int    // 0 if not overridden
+	tlsVersion uint16 // the highest TLS version offered by the client
+}
+
+func (conn *dialClientConn) BackendPort() int { return conn.port }
+
+// splitSNIPort splits an SNI hostname with a :port suffix into the
+// hostname and port
+func splitSNIPort(serverName string) (string, int, bool) {
+	host, portString, err := net.SplitHostPort(serverName)
+	if err != nil || host == "" {
+		return "", 0, false
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, false
+	}
+	return host, int(port), true
+}
 
+func (server *Server) handleConnection(clientConn net.Conn, listener listenerLabels) {
 	var clientHello *tls.ClientHelloInfo
 
-	if peekedClientHello, peekedClientConn, err := server.peekClientHello(clientConn); err == nil {
+	phases := connPhases{start: time.Now()}
+	server.setNoDelay(clientConn)
+	if server.sampleTrace() {
+		clientAddr := clientConn.RemoteAddr()
+		defer func() {
+			phases.closed = time.Now()
+			serverName := ""
+			if clientHello != nil {
+				serverName = clientHello.ServerName
+			}
+			phases.log(clientAddr, serverName)
+		}()
+	}
+
+	var outcome connOutcome
+	if server.Tracer != nil {
+		outcome.traceID = newTraceID()
+	}
+	tarpitted := false
+	rawClientConn := clientConn
+	defer func() {
+		if !tarpitted {
+			if outcome.err != nil && server.resetOnError(outcome.err) {
+				setResetOnClose(rawClientConn)
+			}
+			clientConn.Close()
+		}
+	}()
+
+	defer func() {
+		serverName := ""
+		if clientHello != nil {
+			serverName = clientHello.ServerName
+		}
+		server.logConnection(clientConn.RemoteAddr(), serverName, phases.start, &outcome)
+		server.auditConnection(clientConn.RemoteAddr(), serverName, &outcome)
+		if server.Tracer != nil {
+			server.Tracer.Record(newConnectionSpan(phases.start, serverName, listener, &outcome))
+		}
+	}()
+	fail := func(err error) {
+		server.Metrics.countError(listener, err)
+		server.recordBackendError(err)
+		outcome.err = err
+	}
+	reject := func(rule string, err error) {
+		fail(server.Metrics.reject(listener, rule, err))
+	}
+
+	var inboundProxyHeader *proxyHeader
+	if server.AcceptProxyProtocol && server.trustedProxy(clientConn.RemoteAddr()) {
+		header, err := server.readProxyHeader(clientConn)
+		if err != nil {
+			fail(fmt.Errorf("%w: %w", errProxyHeaderRead, err))
+			return
+		}
+		inboundProxyHeader = header
+		if header.RemoteAddr != nil {
+			clientConn = &proxiedConn{Conn: clientConn, remoteAddr: header.RemoteAddr, localAddr: header.LocalAddr}
+		}
+	}
+
+	if server.GeoIP != nil {
+		outcome.country = server.GeoIP.Country(clientConn.RemoteAddr())
+		listener.metrics.countries.WithLabelValues(outcome.country).Inc()
+	}
+
+	if server.ClientConnLimit != nil {
+		clientAddr := clientConn.RemoteAddr()
+		if !server.ClientConnLimit.Acquire(clientAddr) {
+			reject("max-conns-per-client", errClientConnLimit)
+			return
+		}
+		defer server.ClientConnLimit.Release(clientAddr)
+	}
+
+	var helloBytes []byte
+	if peekedClientHello, peekedBytes, err := server.peekClientHello(clientConn, listener); err == nil {
+		phases.peeked = time.Now()
+		listener.metrics.peeksOK.Inc()
 		clientHello = peekedClientHello
-		clientConn = peekedClientConn
+		helloBytes = peekedBytes
 	} else {
-		if !errors.Is(err, io.EOF) && !os.IsTimeout(err) {
-			// Ignore client EOF/timeout errors as they're almost certainly
-			// scanners closing the connection immediately
-			log.Printf("Peeking client hello from %s failed: %s", clientConn.RemoteAddr(), err)
+		listener.metrics.peeksFailed.Inc()
+		fail(err)
+		// Client EOF/timeout errors are almost certainly scanners
+		// closing the connection immediately
+		outcome.quiet = errors.Is(err, io.EOF) || isTimeout(err)
+		if errors.Is(err, errNoSNI) {
+			server.Webhook.Send(&Event{Type: EventNoSNI, Time: time.Now(), ClientAddr: clientConn.RemoteAddr().String()})
+			tarpitted = server.tarpit(clientConn, listener)
+		}
+		return
+	}
+
+	dialConn := &dialClientConn{ClientConn: clientConn, listener: listener, tlsVersion: highestTLSVersion(clientHello)}
+	if server.LenientSNIPort {
+		if hostname, port, ok := splitSNIPort(clientHello.ServerName); ok {
+			clientHello.ServerName = hostname
+			dialConn.port = port
+		}
+	}
+
+	if !hasRealCipherSuite(clientHello) {
+		listener.metrics.bogusHellos.Inc()
+		if server.RejectBogusHello {
+			reject("reject-bogus-hello", errBogusHello)
+			return
 		}
+	}
+
+	if server.MinTLSVersion != 0 && dialConn.tlsVersion < server.MinTLSVersion {
+		reject("min-tls-version", fmt.Errorf("%w (highest offered version is %s)", errTLSTooOld, tls.VersionName(dialConn.tlsVersion)))
 		return
 	}
 
-	backendConn, err := server.Backend.Dial(clientHello.ServerName, clientHello.SupportedProtos, clientConn)
+	lifetime, err := server.maxLifetime(helloBytes)
 	if err != nil {
-		log.Printf("Ignoring connection from %s to %s because dialing backend failed: %s", clientConn.RemoteAddr(), clientHello.ServerName, err)
+		reject("lifetime-extension", err)
 		return
 	}
-	defer backendConn.Close()
 
-	if server.ProxyProtocol {
-		header := proxy.Header{RemoteAddr: clientConn.RemoteAddr(), LocalAddr: clientConn.LocalAddr()}
-		if _, err := backendConn.Write(header.Format()); err != nil {
-			log.Printf("Error writing PROXY header to backend: %s", err)
+	if server.RequireALPN && len(clientHello.SupportedProtos) == 0 {
+		reject("require-alpn", errNoALPN)
+		return
+	}
+
+	if server.NormalizeIDN {
+		hostname, err := normalizeIDN(clientHello.ServerName)
+		if err != nil {
+			reject("normalize-idn", fmt.Errorf("%w: %w", errInvalidIDN, err))
 			return
 		}
+		clientHello.ServerName = hostname
 	}
 
+	if net.ParseIP(clientHello.ServerName) != nil {
+		if server.IPLiteralSNIHostname == "" {
+			listener.metrics.ipLiteralRejected.Inc()
+			reject("ip-literal-sni-hostname", errIPLiteralSNI)
+			return
+		}
+		listener.metrics.ipLiteralRerouted.Inc()
+		clientHello.ServerName = server.IPLiteralSNIHostname
+	}
+
+	if server.RequireFQDN {
+		if err := checkFQDN(clientHello.ServerName, server.AllowSingleLabelSNI); err != nil {
+			reject("require-fqdn", fmt.Errorf("%w: %w", errInvalidSNI, err))
+			return
+		}
+	}
+
+	if server.DeniedSNI.Contains(clientHello.ServerName) {
+		reject("deny-sni-suffix", fmt.Errorf("%w: %q", errSNIDenied, clientHello.ServerName))
+		return
+	}
+	if server.AllowedSNI != nil && !server.AllowedSNI.Contains(clientHello.ServerName) {
+		reject("allow-sni-suffix", fmt.Errorf("%w: %q", errSNIDenied, clientHello.ServerName))
+		return
+	}
+
+	server.TopHostnames.Observe(clientHello.ServerName)
+
+	if server.DrainedBackends.IsDrained(clientHello.ServerName) {
+		reject("drain-backend", &BackendError{Backend: clientHello.ServerName, Err: errBackendDrained})
+		return
+	}
+
+	dialStart := time.Now()
+	rawBackendConn, err := server.backendFor(listener).Dial(clientHello.ServerName, clientHello.SupportedProtos, dialConn)
+	if server.ObserveOnly {
+		if err != nil && !errors.Is(err, errObserved) {
+			backendErr := &BackendError{Backend: clientHello.ServerName, Address: dialedAddress(err), DialDuration: time.Since(dialStart), Err: err}
+			server.Metrics.observedDecisions.WithLabelValues(errorLabelValue(backendErr)).Inc()
+			fail(backendErr)
+			return
+		}
+		address := dialedAddress(err)
+		if err == nil {
+			address = rawBackendConn.RemoteAddr().String()
+			rawBackendConn.Close()
+		}
+		server.Metrics.observedDecisions.WithLabelValues("allowed").Inc()
+		outcome.observed = true
+		log.Printf("Observed connection from %s to %q: would connect to %s", clientConn.RemoteAddr(), clientHello.ServerName, address)
+		return
+	}
+	if err != nil {
+		backendErr := &BackendError{Backend: clientHello.ServerName, Address: dialedAddress(err), DialDuration: time.Since(dialStart), Err: err}
+		fail(backendErr)
+		server.Webhook.Send(&Event{Type: EventDenied, Time: time.Now(), ClientAddr: clientConn.RemoteAddr().String(), ServerName: clientHello.ServerName, BackendAddr: backendErr.Address, DialSeconds: backendErr.DialDuration.Seconds()})
+		if errors.Is(err, errDisallowedBackend) || server.TarpitAllDown && errors.Is(err, errAllBackendsDown) {
+			tarpitted = server.tarpit(clientConn, listener)
+		}
+		return
+	}
+	phases.dialed = time.Now()
+	server.setNoDelay(rawBackendConn)
+	server.DialLatency.Observe(clientHello.ServerName, phases.dialed.Sub(dialStart))
+	server.Metrics.observeDialDuration(listener, outcome.traceID, phases.dialed.Sub(dialStart))
+	backendConn := server.Metrics.throughput.Track(clientHello.ServerName, rawBackendConn)
+	backendConn.writeBlocked = server.Metrics.writeBlocked.WithLabelValues(server.backendLabel(clientHello.ServerName))
+	backendConn.maxBytes = server.MaxBytes
+	backendConn.maxBytesPerDirection = server.MaxBytesPerDirection
+	defer server.Metrics.throughput.Untrack(backendConn)
+	defer backendConn.Close()
+	outcome.backendConn = backendConn
+	if generation, ok := server.Routes.Pin(clientHello.ServerName); ok {
+		defer server.Routes.Unpin(generation)
+	}
+	server.logEstablished(clientConn.RemoteAddr(), clientHello.ServerName, listener, backendConn.RemoteAddr())
+
+	if server.LogFlows {
+		log.Printf("Flow for %s: client %s -> %s, backend %s -> %s", clientHello.ServerName, clientConn.RemoteAddr(), clientConn.LocalAddr(), backendConn.LocalAddr(), backendConn.RemoteAddr())
+	}
+
+	server.Webhook.Send(&Event{Type: EventAccepted, Time: time.Now(), ClientAddr: clientConn.RemoteAddr().String(), ServerName: clientHello.ServerName, BackendAddr: backendConn.RemoteAddr().String(), DialSeconds: phases.dialed.Sub(dialStart).Seconds(), Accepted: true})
+
+	preamble := server.backendPreamble(clientHello.ServerName)
+	proxyHeader := server.backendProxyHeader(clientHello.ServerName, clientConn, inboundProxyHeader)
+
+	// Send the preamble, PROXY header, and ClientHello in a single write,
+	// so that they reach the backend together even when Nagle's algorithm
+	// is enabled
+	if err := server.replayHello(backendConn, rawBackendConn, preamble, proxyHeader, helloBytes); err != nil {
+		switch {
+		case len(preamble) != 0:
+			err = fmt.Errorf("%w: %w", errPreambleWrite, err)
+		case len(proxyHeader) != 0:
+			err = fmt.Errorf("%w: %w", errProxyHeaderWrite, err)
+		}
+		fail(&BackendError{Backend: clientHello.ServerName, Err: err})
+		return
+	}
+
+	if idleTimeout := server.idleTimeout(clientHello.ServerName); idleTimeout != 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go backendConn.closeWhenIdle(clientConn, idleTimeout, done)
+	}
+	if lifetime != 0 {
+		timer := time.AfterFunc(lifetime, func() {
+			backendConn.lifetimeExceeded.Store(true)
+			backendConn.BackendConn.Close()
+			clientConn.Close()
+		})
+		defer timer.Stop()
+	}
+
+	// Whichever copy finishes first determines which side closed its
+	// stream first
+	var closedFirst atomic.Int32
+
 	go func() {
 		io.Copy(backendConn, clientConn)
-		backendConn.CloseWrite()
+		closedFirst.CompareAndSwap(0, closedByClient)
+		server.closeBackendWrite(backendConn)
 	}()
 
 	io.Copy(clientConn, backendConn)
+	closedFirst.CompareAndSwap(0, closedByBackend)
+	if closedFirst.Load() == closedByClient {
+		server.Metrics.streamCloses.WithLabelValues("client").Inc()
+	} else {
+		server.Metrics.streamCloses.WithLabelValues("backend").Inc()
+	}
+	phases.firstByte = backendConn.firstReadTime()
+	if backendConn.maxBytesExceeded.Load() {
+		fail(errByteLimitExceeded)
+	}
+	if backendConn.idleTimedOut.Load() {
+		fail(errIdleTimeout)
+	}
+	if backendConn.lifetimeExceeded.Load() {
+		fail(errLifetimeExceeded)
+	}
+}
+
+// idleTimeout returns the idle timeout for the backend of hostname, from
+// its route if it has one, or IdleTimeout otherwise
+func (server *Server) idleTimeout(hostname string) time.Duration {
+	if route := server.Routes.Lookup(hostname); route != nil && route.IdleTimeout != 0 {
+		return route.IdleTimeout
+	}
+	return server.IdleTimeout
+}
+
+// proxyVersion returns the PROXY protocol version to use for the backend
+// of hostname: none, v1, or v2
+func (server *Server) proxyVersion(origHostname string) string {
+	if !server.ProxyProtocol {
+		return "none"
+	}
+	if hostname, err := canonicalizeHostname(origHostname); err == nil {
+		if version, ok := server.BackendProxyVersions[hostname]; ok {
+			return version
+		}
+		if version, ok := server.BackendProxyVersions[wildcardHostname(hostname)]; ok {
+			return version
+		}
+	}
+	return "v2"
 }
 
+// backendProxyHeader returns the PROXY header to send to the backend of
+// hostname, or nil if none should be sent.  TLVs from inbound which are
+// permitted by -proxy-tlv are passed through in v2 headers.
+func (server *Server) backendProxyHeader(hostname string, clientConn ClientConn, inbound *proxyHeader) []byte {
+	switch server.proxyVersion(hostname) {
+	case "v1":
+		return formatProxyHeaderV1(clientConn.RemoteAddr(), clientConn.LocalAddr())
+	case "v2":
+		if tlvs := inbound.filterTLVs(server.ProxyTLVs); len(tlvs) != 0 {
+			return formatProxyHeader(clientConn.RemoteAddr(), clientConn.LocalAddr(), tlvs)
+		}
+		return proxy.Header{RemoteAddr: clientConn.RemoteAddr(), LocalAddr: clientConn.LocalAddr()}.Format()
+	}
+	return nil
+}
+
+// backendPreamble returns the bytes to write to the backend of hostname
+// before anything else
+func (server *Server) backendPreamble(origHostname string) []byte {
+	if len(server.BackendPreambles) == 0 {
+		return nil
+	}
+	if hostname, err := canonicalizeHostname(origHostname); err == nil {
+		if preamble, ok := server.BackendPreambles[hostname]; ok {
+			return preamble
+		}
+		if preamble, ok := server.BackendPreambles[wildcardHostname(hostname)]; ok {
+			return preamble
+		}
+	}
+	return nil
+}
+
+// trustedProxy reports whether a PROXY header may be read from a client
+// with the given address
+func (server *Server) trustedProxy(addr net.Addr) bool {
+	if len(server.TrustedProxyCIDRs) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	return cidrsContain(server.TrustedProxyCIDRs, tcpAddr.IP)
+}
+
+func (server *Server) readProxyHeader(clientConn net.Conn) (*proxyHeader, error) {
+	headerTimeout := server.HeaderTimeout
+	if headerTimeout == 0 {
+		headerTimeout = defaultHeaderTimeout
+	}
+	if err := clientConn.SetReadDeadline(time.Now().Add(headerTimeout)); err != nil {
+		return nil, err
+	}
+	return readProxyHeader(clientConn)
+}
+
+// backendFor returns the BackendDialer for connections accepted by listener
+func (server *Server) backendFor(listener listenerLabels) BackendDialer {
+	if backend, ok := server.ListenerBackends[listener.name]; ok {
+		return backend
+	}
+	return server.Backend
+}
+
+func (server *Server) tarpit(clientConn net.Conn, listener listenerLabels) bool {
+	if server.Tarpit == nil || !server.Tarpit.Hold(clientConn) {
+		return false
+	}
+	listener.metrics.tarpitted.Inc()
+	return true
+}
+
+// backendLabel returns the value of the backend metric label for
+// connections to hostname: the backend of its route, or "other" if it has
+// none, so that the label's values are bounded by the configured routes
+// rather than by whatever SNI clients send
+func (server *Server) backendLabel(hostname string) string {
+	if route := server.Routes.Lookup(hostname); route != nil && route.Backend != "" {
+		return route.Backend
+	}
+	return "other"
+}
+
+// recordBackendError records err in LastErrors if it is an error with a
+// backend which a route was configured for
+func (server *Server) recordBackendError(err error) {
+	var backendErr *BackendError
+	if server.LastErrors == nil || !errors.As(err, &backendErr) {
+		return
+	}
+	if route := server.Routes.Lookup(backendErr.Backend); route != nil {
+		server.LastErrors.Record(route.Backend, err)
+	}
+}
+
+func (server *Server) closeBackendWrite(backendConn *instrumentedConn) {
+	_, isUnix := backendConn.BackendConn.(*net.UnixConn)
+	fullClose := isUnix && server.UnixFullClose
+	if server.DisableHalfClose && !fullClose {
+		return
+	}
+	if server.CloseWriteDelay != 0 {
+		time.Sleep(server.CloseWriteDelay)
+	}
+	if fullClose {
+		backendConn.Close()
+	} else {
+		backendConn.CloseWrite()
+	}
+}
+
+// replayHello writes preamble, proxyHeader, and helloBytes to backendConn,
+// in that order, in a single write.  If DisableNoDelay is true,
+// TCP_NODELAY is enabled for the duration of the write, so that the
+// backend isn't kept waiting for the ClientHello.
+func (server *Server) replayHello(backendConn *instrumentedConn, rawBackendConn BackendConn, preamble, proxyHeader, helloBytes []byte) error {
+	if tcpConn, ok := rawBackendConn.(*net.TCPConn); ok && server.DisableNoDelay {
+		if err := tcpConn.SetNoDelay(true); err == nil {
+			defer tcpConn.SetNoDelay(false)
+		}
+	}
+	return writeFull(backendConn, slices.Concat(preamble, proxyHeader, helloBytes))
+}
+
+// setNoDelay sets TCP_NODELAY on conn according to DisableNoDelay.  Other
+// types of connection are left alone.
+func (server *Server) setNoDelay(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetNoDelay(!server.DisableNoDelay); err != nil {
+		log.Printf("Failed to set TCP_NODELAY on connection to %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// acquireHandler blocks until fewer than MaxHandlers connections are
+// being handled, and then counts a new one.  It returns false without
+// counting one if ctx is done first.
+func (server *Server) acquireHandler(ctx context.Context) bool {
+	if server.MaxHandlers != 0 {
+		server.handlerSlotsOnce.Do(func() { server.handlerSlots = make(chan struct{}, server.MaxHandlers) })
+		select {
+		case server.handlerSlots <- struct{}{}:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	server.Metrics.activeHandlers.Inc()
+	return true
+}
+
+func (server *Server) releaseHandler() {
+	server.Metrics.activeHandlers.Dec()
+	if server.MaxHandlers != 0 {
+		<-server.handlerSlots
+	}
+}
+
+// Serve accepts connections from listener and handles them, until
+// accepting fails
 func (server *Server) Serve(listener net.Listener) error {
+	return server.ServeContext(context.Background(), listener)
+}
+
+// ServeContext is like Serve, but when ctx is cancelled, it closes
+// listener and returns nil.  Connections which have already been accepted
+// continue to be handled.
+func (server *Server) ServeContext(ctx context.Context, listener net.Listener) error {
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			listener.Close()
+		case <-stopped:
+		}
+	}()
+
+	labels := server.Metrics.newListenerLabels(listener.Addr())
 	for {
+		if !server.acquireHandler(ctx) {
+			listener.Close()
+			return nil
+		}
 		conn, err := listener.Accept()
 		if err != nil {
+			server.releaseHandler()
+			if ctx.Err() != nil {
+				listener.Close()
+				return nil
+			}
 			if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Temporary() {
 				log.Printf("Temporary network error accepting connection: %s", netErr)
 				continue
 			}
 			return err
 		}
-		go server.handleConnection(conn)
+		if server.Readiness.IsWarming() {
+			labels.metrics.warmupRejected.Inc()
+			conn.Close()
+			server.releaseHandler()
+			continue
+		}
+		if server.draining.Load() {
+			conn.Close()
+			server.releaseHandler()
+			continue
+		}
+		go func() {
+			defer server.releaseHandler()
+			server.handleConnection(conn, labels)
+		}()
 	}
 }
@@ -0,0 +1,278 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// recordingConn records each call to Write before passing it on
+type recordingConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (conn *recordingConn) Write(p []byte) (int, error) {
+	conn.writes = append(conn.writes, bytes.Clone(p))
+	return conn.Conn.Write(p)
+}
+
+type fakeClientConn struct {
+	localAddr, remoteAddr net.Addr
+}
+
+func (conn fakeClientConn) LocalAddr() net.Addr  { return conn.localAddr }
+func (conn fakeClientConn) RemoteAddr() net.Addr { return conn.remoteAddr }
+
+func TestReplayHelloSingleWrite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	rawBackendConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rawBackendConn.Close()
+	backendSide, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backendSide.Close()
+
+	server := &Server{
+		ProxyProtocol:        true,
+		BackendProxyVersions: map[string]string{"example.com": "v1"},
+		BackendPreambles:     map[string][]byte{"example.com": []byte("PREAMBLE\r\n")},
+		DisableNoDelay:       true,
+	}
+	clientConn := fakeClientConn{
+		localAddr:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+		remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234},
+	}
+	preamble := server.backendPreamble("example.com")
+	proxyHeader := server.backendProxyHeader("example.com", clientConn, nil)
+	helloBytes := []byte("\x16\x03\x01\x00\x05hello")
+	want := []byte("PREAMBLE\r\nPROXY TCP4 192.0.2.1 198.51.100.1 51234 443\r\n\x16\x03\x01\x00\x05hello")
+	if got := slices.Concat(preamble, proxyHeader, helloBytes); !bytes.Equal(got, want) {
+		t.Fatalf("initial bytes are %q, want %q", got, want)
+	}
+
+	recorder := &recordingConn{Conn: rawBackendConn}
+	backendConn := &instrumentedConn{BackendConn: recorder}
+	if err := server.replayHello(backendConn, rawBackendConn, preamble, proxyHeader, helloBytes); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.writes) != 1 {
+		t.Fatalf("replayHello made %d writes, want 1: %q", len(recorder.writes), recorder.writes)
+	}
+	if !bytes.Equal(recorder.writes[0], want) {
+		t.Errorf("replayHello wrote %q, want %q", recorder.writes[0], want)
+	}
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(backendSide, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("backend received %q, want %q", got, want)
+	}
+}
+
+// unixSocketPair returns both ends of a connection to a UNIX socket
+func unixSocketPair(t *testing.T) (snidSide *net.UnixConn, backendSide *net.UnixConn) {
+	t.Helper()
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(t.TempDir(), "backend.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	snidSide, err = net.DialUnix("unix", nil, listener.Addr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { snidSide.Close() })
+	backendSide, err = listener.AcceptUnix()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backendSide.Close() })
+	return snidSide, backendSide
+}
+
+func TestCloseBackendWriteUnix(t *testing.T) {
+	tests := []struct {
+		disableHalfClose bool
+		unixFullClose    bool
+		backendSeesEOF   bool
+		fullClose        bool
+	}{
+		{false, false, true, false},
+		{false, true, true, true},
+		{true, false, false, false},
+		{true, true, true, true},
+	}
+	for _, test := range tests {
+		server := &Server{DisableHalfClose: test.disableHalfClose, UnixFullClose: test.unixFullClose}
+		snidSide, backendSide := unixSocketPair(t)
+		backendConn := &instrumentedConn{BackendConn: snidSide}
+		server.closeBackendWrite(backendConn)
+
+		backendSide.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := backendSide.Read(make([]byte, 1))
+		if test.backendSeesEOF && err != io.EOF {
+			t.Errorf("DisableHalfClose=%v UnixFullClose=%v: backend read got %v, want EOF", test.disableHalfClose, test.unixFullClose, err)
+		} else if !test.backendSeesEOF && !isTimeout(err) {
+			t.Errorf("DisableHalfClose=%v UnixFullClose=%v: backend read got %v, want a timeout", test.disableHalfClose, test.unixFullClose, err)
+		}
+
+		// The backend can still respond after a half-close, but not
+		// after a full close
+		_, writeErr := backendSide.Write([]byte("response"))
+		response := make([]byte, len("response"))
+		_, readErr := io.ReadFull(backendConn, response)
+		if test.fullClose {
+			if writeErr == nil && !errors.Is(readErr, net.ErrClosed) {
+				t.Errorf("DisableHalfClose=%v UnixFullClose=%v: response got through after a full close", test.disableHalfClose, test.unixFullClose)
+			}
+		} else if writeErr != nil || readErr != nil || string(response) != "response" {
+			t.Errorf("DisableHalfClose=%v UnixFullClose=%v: response got %q, %v, %v", test.disableHalfClose, test.unixFullClose, response, writeErr, readErr)
+		}
+	}
+}
+
+func TestBackendLabel(t *testing.T) {
+	routes := NewRouteTable()
+	routes.Set("example.com", &Route{Backend: "192.0.2.1:443"})
+	routes.Set("_.example.net", &Route{Backend: "backend.example.net"})
+	routes.Set("versions.example.com", &Route{TLSVersionBackends: []TLSVersionBackend{{MinVersion: tls.VersionTLS13, MaxVersion: 0xffff, Backend: "192.0.2.2:443"}}})
+	server := &Server{Routes: routes}
+
+	tests := []struct {
+		hostname string
+		want     string
+	}{
+		{"example.com", "192.0.2.1:443"},
+		{"EXAMPLE.com.", "192.0.2.1:443"},
+		{"www.example.net", "backend.example.net"},
+		{"versions.example.com", "other"},
+		{"unrouted.example.org", "other"},
+		{"", "other"},
+	}
+	for _, test := range tests {
+		if got := server.backendLabel(test.hostname); got != test.want {
+			t.Errorf("backendLabel(%q) = %q, want %q", test.hostname, got, test.want)
+		}
+	}
+	if got := (&Server{}).backendLabel("example.com"); got != "other" {
+		t.Errorf("backendLabel without routes = %q, want %q", got, "other")
+	}
+}
+
+type backendDialerFunc func(hostname string, protocols []string, clientConn ClientConn) (BackendConn, error)
+
+func (dial backendDialerFunc) Dial(hostname string, protocols []string, clientConn ClientConn) (BackendConn, error) {
+	return dial(hostname, protocols, clientConn)
+}
+
+func TestHandleConnectionProxyHeaderV1(t *testing.T) {
+	hello := recordClientHello(t, "example.com")
+	tests := []struct {
+		name                  string
+		remoteAddr, localAddr net.Addr
+		want                  string
+	}{
+		{
+			name:       "IPv4",
+			remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234},
+			localAddr:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+			want:       "PROXY TCP4 192.0.2.1 198.51.100.1 51234 443\r\n",
+		},
+		{
+			name:       "IPv6",
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+			localAddr:  &net.TCPAddr{IP: net.ParseIP("2001:db8::443"), Port: 443},
+			want:       "PROXY TCP6 2001:db8::1 2001:db8::443 51234 443\r\n",
+		},
+		{
+			name:       "UNKNOWN",
+			remoteAddr: &net.UnixAddr{Name: "@", Net: "unix"},
+			localAddr:  &net.UnixAddr{Name: "/run/snid.sock", Net: "unix"},
+			want:       "PROXY UNKNOWN\r\n",
+		},
+	}
+	for _, test := range tests {
+		snidSide, backendSide := unixSocketPair(t)
+		recorder := &recordingConn{Conn: snidSide}
+		server := &Server{
+			Backend: backendDialerFunc(func(hostname string, protocols []string, clientConn ClientConn) (BackendConn, error) {
+				return recorder, nil
+			}),
+			Metrics:              NewMetrics(),
+			HeaderTimeout:        5 * time.Second,
+			LogConnections:       LogConnectionsNone,
+			ProxyProtocol:        true,
+			BackendProxyVersions: map[string]string{"example.com": "v1"},
+		}
+		listener := server.Metrics.newListenerLabels(test.localAddr)
+
+		clientSide, serverSide := net.Pipe()
+		go func() {
+			clientSide.Write(hello)
+			clientSide.Close()
+		}()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			server.handleConnection(&proxiedConn{Conn: pipeConn{serverSide}, remoteAddr: test.remoteAddr, localAddr: test.localAddr}, listener)
+		}()
+
+		want := append([]byte(test.want), hello...)
+		got := make([]byte, len(want))
+		backendSide.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(backendSide, got); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		backendSide.Close()
+		<-done
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: backend received %q, want %q", test.name, got, want)
+		}
+		if len(recorder.writes) == 0 || !bytes.Equal(recorder.writes[0], want) {
+			t.Errorf("%s: first write to backend was %q, want the PROXY header and ClientHello together", test.name, recorder.writes)
+		}
+	}
+}
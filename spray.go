@@ -0,0 +1,91 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SprayBackend is a backend which connections are sprayed across in
+// spray mode, in proportion to Weight
+type SprayBackend struct {
+	Address string // as in a Route
+	Weight  int
+}
+
+// parseSprayBackends parses a comma-separated list of ADDRESS@WEIGHT,
+// where the weight defaults to 1 if omitted
+func parseSprayBackends(arg string) ([]SprayBackend, error) {
+	var backends []SprayBackend
+	for _, field := range strings.Split(arg, ",") {
+		address, weightString, hasWeight := strings.Cut(strings.TrimSpace(field), "@")
+		backend := SprayBackend{Weight: 1}
+		if hasWeight {
+			weight, err := strconv.Atoi(weightString)
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("weight of %q must be a positive integer", address)
+			}
+			backend.Weight = weight
+		}
+		var err error
+		if backend.Address, err = parseRouteBackend(address); err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// chooseSprayBackend chooses one of backends at random, in proportion to
+// their weights
+func chooseSprayBackend(backends []SprayBackend) string {
+	total := 0
+	for _, backend := range backends {
+		total += backend.Weight
+	}
+	n := rand.IntN(total)
+	for _, backend := range backends[:len(backends)-1] {
+		if n < backend.Weight {
+			return backend.Address
+		}
+		n -= backend.Weight
+	}
+	return backends[len(backends)-1].Address
+}
+
+// dialSpray dials one of the Spray backends, chosen at random by weight,
+// regardless of the hostname
+func (backend *TCPDialer) dialSpray(dialer net.Dialer, clientConn ClientConn) (BackendConn, error) {
+	address := chooseSprayBackend(backend.Spray)
+	if backend.Metrics != nil {
+		backend.Metrics.sprayed.WithLabelValues(address).Inc()
+	}
+	return backend.dialRoute(dialer, &Route{Backend: address}, clientConn)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -20,20 +21,28 @@ func getSRVService(protocols []string) string {
 	return ""
 }
 
-func dialSRV(dialer net.Dialer, network string, hostname string, service string) (net.Conn, error) {
-	_, addrs, err := net.LookupSRV(service, "tcp", hostname)
+// lookupSRV looks up the _service._proto SRV records for hostname, which
+// net.LookupSRV sorts by priority and randomizes by weight
+func lookupSRV(resolver *net.Resolver, hostname string, service string, proto string) ([]*net.SRV, error) {
+	_, addrs, err := resolver.LookupSRV(context.Background(), service, proto, hostname)
 	if err != nil {
 		return nil, err
 	}
 	if len(addrs) == 0 {
 		return nil, fmt.Errorf("no SRV records exist for %s on %s", service, hostname)
 	}
+	return addrs, nil
+}
 
+// dialSRV dials the targets of addrs using dial, in order
+func dialSRV(addrs []*net.SRV, dial func(host string, port string) (BackendConn, error)) (BackendConn, error) {
 	var errs []error
 	for _, addr := range addrs {
-		conn, err := dialer.Dial(network, net.JoinHostPort(addr.Target, strconv.FormatUint(uint64(addr.Port), 10)))
+		conn, err := dial(addr.Target, strconv.FormatUint(uint64(addr.Port), 10))
 		if err == nil {
 			return conn, nil
+		} else if errors.Is(err, errObserved) {
+			return nil, err
 		}
 		errs = append(errs, err)
 	}
@@ -0,0 +1,210 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// StatsSocket serves a simple line-based command protocol for inspecting
+// snid, similar to HAProxy's stats socket.  Each command is one line, and
+// each response ends with an empty line.
+type StatsSocket struct {
+	Metrics   *Metrics
+	Readiness *Readiness
+	Mode      string
+	Listeners []string
+
+	TopHostnames *TopHostnames // may be nil
+	LastErrors   *LastErrors   // may be nil
+
+	DrainedBackends *DrainedBackends
+
+	startTime time.Time
+}
+
+func (socket *StatsSocket) Serve(listener net.Listener) error {
+	socket.startTime = time.Now()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go socket.handleConnection(conn)
+	}
+}
+
+func (socket *StatsSocket) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		w := bufio.NewWriter(conn)
+		if command := strings.Join(strings.Fields(scanner.Text()), " "); command != "" {
+			socket.runCommand(w, command)
+			fmt.Fprintln(w)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (socket *StatsSocket) runCommand(w io.Writer, command string) {
+	switch command {
+	case "show info":
+		socket.showInfo(w)
+	case "show stat":
+		socket.showStat(w)
+	case "show top":
+		socket.showTop(w)
+	case "show errors":
+		socket.showErrors(w)
+	default:
+		if verb, hostname, ok := strings.Cut(command, " "); ok && (verb == "drain-backend" || verb == "undrain-backend") {
+			socket.setBackendDrained(w, hostname, verb == "drain-backend")
+			return
+		}
+		fmt.Fprintln(w, "Unknown command. Commands are: show info, show stat, show top, show errors, drain-backend HOSTNAME, undrain-backend HOSTNAME")
+	}
+}
+
+func (socket *StatsSocket) showInfo(w io.Writer) {
+	fmt.Fprintf(w, "pid: %d\n", os.Getpid())
+	fmt.Fprintf(w, "uptime_seconds: %d\n", int64(time.Since(socket.startTime).Seconds()))
+	fmt.Fprintf(w, "mode: %s\n", socket.Mode)
+	fmt.Fprintf(w, "listeners: %s\n", strings.Join(socket.Listeners, " "))
+	fmt.Fprintf(w, "ready: %t\n", socket.Readiness.IsReady())
+	fmt.Fprintf(w, "draining: %t\n", socket.Readiness.IsDraining())
+	fmt.Fprintf(w, "drained_backends: %s\n", strings.Join(socket.DrainedBackends.List(), " "))
+	fmt.Fprintf(w, "goroutines: %d\n", runtime.NumGoroutine())
+	if n, err := countOpenFiles(); err == nil {
+		fmt.Fprintf(w, "open_fds: %d\n", n)
+	}
+}
+
+// showStat writes one line per metric sample, in the form
+// NAME{LABEL="VALUE",...} VALUE, with histograms as _count and _sum
+func (socket *StatsSocket) showStat(w io.Writer) {
+	families, err := socket.Metrics.Registry.Gather()
+	if err != nil {
+		fmt.Fprintf(w, "Error gathering metrics: %s\n", err)
+		return
+	}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := statsLabels(m.GetLabel())
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				writeStat(w, family.GetName(), labels, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				writeStat(w, family.GetName(), labels, m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				writeStat(w, family.GetName()+"_count", labels, float64(m.GetHistogram().GetSampleCount()))
+				writeStat(w, family.GetName()+"_sum", labels, m.GetHistogram().GetSampleSum())
+			}
+		}
+	}
+}
+
+// showTop writes one line per tracked hostname, most requested first, in
+// the form HOSTNAME COUNT ERROR
+func (socket *StatsSocket) showTop(w io.Writer) {
+	if socket.TopHostnames == nil {
+		fmt.Fprintln(w, "Hostname tracking is disabled; enable it with -top-hostnames")
+		return
+	}
+	for _, entry := range socket.TopHostnames.Snapshot() {
+		fmt.Fprintf(w, "%s %d %d\n", entry.Hostname, entry.Count, entry.Error)
+	}
+}
+
+// showErrors writes one line per tracked backend, most recently failed
+// first, in the form BACKEND TIME ERROR
+func (socket *StatsSocket) showErrors(w io.Writer) {
+	if socket.LastErrors == nil {
+		fmt.Fprintln(w, "Error tracking is disabled; enable it with -last-backend-errors")
+		return
+	}
+	for _, entry := range socket.LastErrors.Snapshot() {
+		fmt.Fprintf(w, "%s %s %s\n", entry.Backend, entry.Time.UTC().Format(time.RFC3339), entry.Error)
+	}
+}
+
+func (socket *StatsSocket) setBackendDrained(w io.Writer, hostname string, isDrained bool) {
+	if err := socket.DrainedBackends.SetDrained(hostname, isDrained); err != nil {
+		fmt.Fprintf(w, "Invalid hostname %q: %s\n", hostname, err)
+		return
+	}
+	if isDrained {
+		log.Printf("Draining backend for %s", hostname)
+		fmt.Fprintf(w, "Drained backend for %s\n", hostname)
+	} else {
+		log.Printf("Undraining backend for %s", hostname)
+		fmt.Fprintf(w, "Undrained backend for %s\n", hostname)
+	}
+}
+
+func statsLabels(labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label.GetName() + "=" + strconv.Quote(label.GetValue())
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func writeStat(w io.Writer, name string, labels string, value float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// listenStatsSocket listens on a UNIX socket at path, replacing any stale
+// socket left by a previous process
+func listenStatsSocket(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Serving stats socket on %s", path)
+	return listener, nil
+}
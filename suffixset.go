@@ -0,0 +1,94 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"strings"
+)
+
+// SuffixSet is a set of domain suffixes, stored as a trie of labels from
+// the rightmost label leftwards, so that checking a hostname takes time
+// proportional to its number of labels, regardless of the number of
+// suffixes.  A suffix like example.com matches example.com and every
+// hostname under it; a suffix with a leading dot, like .example.com,
+// only matches the hostnames under it.
+type SuffixSet struct {
+	root suffixNode
+}
+
+type suffixNode struct {
+	children   map[string]*suffixNode
+	self       bool // the suffix itself is in the set
+	subdomains bool // every hostname under the suffix is in the set
+}
+
+// Add adds suffix to the set
+func (set *SuffixSet) Add(suffix string) {
+	suffix = strings.TrimSuffix(strings.ToLower(suffix), ".")
+	suffix, subdomainsOnly := strings.CutPrefix(suffix, ".")
+	node := &set.root
+	if suffix != "" {
+		labels := strings.Split(suffix, ".")
+		for i := len(labels) - 1; i >= 0; i-- {
+			child, ok := node.children[labels[i]]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[string]*suffixNode)
+				}
+				child = new(suffixNode)
+				node.children[labels[i]] = child
+			}
+			node = child
+		}
+	}
+	node.subdomains = true
+	node.self = node.self || !subdomainsOnly
+}
+
+// Contains reports whether hostname matches one of the suffixes in the
+// set.  A nil SuffixSet is empty.
+func (set *SuffixSet) Contains(hostname string) bool {
+	if set == nil {
+		return false
+	}
+	hostname = strings.TrimSuffix(strings.ToLower(hostname), ".")
+	node := &set.root
+	for hostname != "" {
+		if node.subdomains {
+			return true
+		}
+		var label string
+		if dot := strings.LastIndexByte(hostname, '.'); dot == -1 {
+			label, hostname = hostname, ""
+		} else {
+			label, hostname = hostname[dot+1:], hostname[:dot]
+		}
+		if node = node.children[label]; node == nil {
+			return false
+		}
+	}
+	return node.self
+}
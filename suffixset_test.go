@@ -0,0 +1,96 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSuffixSet(t *testing.T) {
+	set := new(SuffixSet)
+	set.Add("example.com")
+	set.Add(".internal")
+	set.Add("Example.NET.")
+	tests := []struct {
+		hostname string
+		want     bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"a.b.example.com", true},
+		{"EXAMPLE.COM.", true},
+		{"notexample.com", false},
+		{"com", false},
+		{"internal", false},
+		{"db.internal", true},
+		{"a.db.internal", true},
+		{"example.net", true},
+		{"www.example.net", true},
+		{"example.org", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := set.Contains(test.hostname); got != test.want {
+			t.Errorf("Contains(%q) = %v, want %v", test.hostname, got, test.want)
+		}
+	}
+	if (*SuffixSet)(nil).Contains("example.com") {
+		t.Error("nil SuffixSet contains example.com")
+	}
+}
+
+func BenchmarkSuffixSetContains(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		set := new(SuffixSet)
+		for i := range n {
+			if i%2 == 0 {
+				set.Add(fmt.Sprintf("customer%d.example.com", i))
+			} else {
+				set.Add(fmt.Sprintf(".tenant%d.internal", i))
+			}
+		}
+		hostnames := []struct {
+			name     string
+			hostname string
+			want     bool
+		}{
+			{"match", fmt.Sprintf("www.customer%d.example.com", n/2), true},
+			{"match-deep", fmt.Sprintf("a.b.c.d.tenant%d.internal", n/2+1), true},
+			{"miss", "www.customer.example.org", false},
+			{"miss-sibling", fmt.Sprintf("www.customer%d.example.com", n+1), false},
+		}
+		for _, test := range hostnames {
+			b.Run(fmt.Sprintf("%d/%s", n, test.name), func(b *testing.B) {
+				for b.Loop() {
+					if set.Contains(test.hostname) != test.want {
+						b.Fatalf("Contains(%q) != %v", test.hostname, test.want)
+					}
+				}
+			})
+		}
+	}
+}
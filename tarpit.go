@@ -0,0 +1,56 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Tarpit holds rejected connections open for a while before closing them,
+// to waste the resources of scanners.  It uses a timer per connection
+// rather than a goroutine, and holds at most Max connections at once.
+type Tarpit struct {
+	Duration time.Duration
+	Max      int64
+
+	active atomic.Int64
+}
+
+// Hold takes ownership of conn and closes it after tarpit.Duration.  If
+// the tarpit is full, it returns false and the caller retains ownership.
+func (tarpit *Tarpit) Hold(conn net.Conn) bool {
+	if tarpit.active.Add(1) > tarpit.Max {
+		tarpit.active.Add(-1)
+		return false
+	}
+	time.AfterFunc(tarpit.Duration, func() {
+		conn.Close()
+		tarpit.active.Add(-1)
+	})
+	return true
+}
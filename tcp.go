@@ -26,52 +26,209 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/netip"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type TCPDialer struct {
 	Port    int
-	Allowed []*net.IPNet
+	Allowed *CIDRSet
+
+	// Backends within these CIDRs are never allowed, even if they are
+	// within Allowed
+	Excluded *CIDRSet
+
+	// Additional per-hostname constraints: a hostname (or wildcard
+	// hostname) listed here may only connect to a backend within one of
+	// its CIDRs, in addition to being within Allowed
+	HostnameAllowed map[string][]*net.IPNet
 
 	// Arguments to pass to net.Dialer
 	Timeout time.Duration
 
+	// If set, the client's address is embedded in the source address
+	// used for backend connections (see nat.go).  At most one may be set.
 	IPv6SourcePrefix net.IP
+	IPv4SourcePrefix *net.IPNet
+
+	// If non-zero, set SO_MARK on backend sockets (Linux only)
+	Mark int
+
+	// If non-zero, set TCP_USER_TIMEOUT on backend sockets, so that
+	// connections with data which goes unacknowledged for this long are
+	// closed (Linux only)
+	UserTimeout time.Duration
+
+	// If SRVService is non-empty, look up the _SRVService._SRVProto SRV
+	// records of hostnames to find the backend, unless the ALPN
+	// protocol already calls for an SRV lookup
+	SRVService string
+	SRVProto   string
+
+	// If non-nil, used instead of the system resolver to look up backends
+	Resolver *net.Resolver
+
+	// If non-nil, hostnames with a route are dialed at the route's
+	// backend address instead of being looked up in the DNS
+	Routes *RouteTable
+
+	// If non-empty, every connection is dialed to one of these backends,
+	// chosen at random by weight, regardless of its hostname (spray mode)
+	Spray []SprayBackend
+
+	// If non-empty, the backend address (as in a Route) to use for
+	// hostnames which have no route and don't exist in the DNS.  The
+	// address is still checked against Allowed, Excluded, and
+	// HostnameAllowed for the original hostname.
+	CatchAll string
+
+	// If true, stop short of connecting to the backend, and return an
+	// error wrapping errObserved (in a *net.OpError containing the
+	// address) once the backend address has been decided and allowed
+	Observe bool
+
+	// If non-nil, DNS lookups and sprayed connections are counted in
+	// Metrics
+	Metrics *Metrics
+
+	// If non-zero, at most this many DNS lookups of backends are done at
+	// once.  Further lookups wait until one finishes, for up to Timeout.
+	MaxLookups int
+
+	// If non-nil, only backend addresses whose PTR records pass this
+	// check are allowed.  This is checked after the other checks, and
+	// only when connecting.
+	PTRChecker *PTRChecker
+
+	// If non-empty, backends are dialed through the HTTP CONNECT proxy at
+	// this address, sending HTTPConnectHeaders (e.g. Proxy-Authorization)
+	// with each request.  Backend checks apply to the target address, not
+	// the proxy's.
+	HTTPConnectProxy   string
+	HTTPConnectHeaders []string
+
+	// If non-zero, when every one of a hostname's allowed addresses
+	// fails to connect, wait this long and then try them all once more,
+	// in case one recovers
+	AllDownRetry time.Duration
+
+	lookupSlots     chan struct{}
+	lookupSlotsOnce sync.Once
+
+	// Addresses of snid's own listeners (see SetListeners), which are
+	// never allowed as backends since connecting to them would loop
+	listeners atomic.Pointer[listenerAddrs]
 }
 
-func (backend *TCPDialer) checkBackend(address string) error {
-	host, _, err := net.SplitHostPort(address)
+func (backend *TCPDialer) hostnameAllowed(origHostname string) ([]*net.IPNet, bool) {
+	hostname, err := canonicalizeHostname(origHostname)
+	if err != nil {
+		return nil, false
+	}
+	if allowed, ok := backend.HostnameAllowed[hostname]; ok {
+		return allowed, true
+	}
+	allowed, ok := backend.HostnameAllowed[wildcardHostname(hostname)]
+	return allowed, ok
+}
+
+func cidrsContain(cidrs []*net.IPNet, ipaddress net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ipaddress) {
+			return true
+		}
+	}
+	return false
+}
+
+func (backend *TCPDialer) checkBackend(hostname string, address string) error {
+	host, portString, err := net.SplitHostPort(address)
 	if err != nil {
 		return err
 	}
+	// Ignore the zone of link-local IPv6 addresses (e.g. fe80::1%eth0),
+	// which doesn't affect CIDR containment
+	host, _, _ = strings.Cut(host, "%")
 	ipaddress := net.ParseIP(host)
 	if ipaddress == nil {
 		return fmt.Errorf("%s is not a valid IP address", host)
 	}
-	for _, cidr := range backend.Allowed {
-		if cidr.Contains(ipaddress) {
-			return nil
+	if ip, ok := netip.AddrFromSlice(ipaddress); ok {
+		if port, err := strconv.Atoi(portString); err == nil && backend.listeners.Load().isListener(ip, port) {
+			return fmt.Errorf("%s is %w", address, errLoopDetected)
+		}
+	}
+	if !backend.Allowed.Contains(ipaddress) || backend.Excluded.Contains(ipaddress) {
+		return fmt.Errorf("%s is %w", ipaddress, errDisallowedBackend)
+	}
+	if allowed, ok := backend.hostnameAllowed(hostname); ok && !cidrsContain(allowed, ipaddress) {
+		return fmt.Errorf("%s is %w for %s", ipaddress, errDisallowedBackend, hostname)
+	}
+	return nil
+}
+
+// checkRoute checks that route's backends are allowed for hostname, if
+// they are IP addresses.  (Other backends are checked when dialing.)
+func (backend *TCPDialer) checkRoute(hostname string, route *Route) error {
+	if err := backend.checkRouteBackend(hostname, route.Backend); err != nil {
+		return err
+	}
+	for _, versionBackend := range route.TLSVersionBackends {
+		if err := backend.checkRouteBackend(hostname, versionBackend.Backend); err != nil {
+			return err
 		}
 	}
-	return fmt.Errorf("%s is not an allowed backend", ipaddress)
+	return nil
 }
 
-func (backend *TCPDialer) bindIPv6(sock syscall.RawConn, clientConn ClientConn) error {
+func (backend *TCPDialer) checkRouteBackend(hostname string, address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, strconv.Itoa(backend.Port)
+	}
+	if ip, _, _ := strings.Cut(host, "%"); net.ParseIP(ip) == nil {
+		return nil
+	}
+	return backend.checkBackend(hostname, net.JoinHostPort(host, port))
+}
+
+func (backend *TCPDialer) sourceAddress(clientConn ClientConn) (syscall.Sockaddr, error) {
 	clientTCPAddress, isTCP := clientConn.RemoteAddr().(*net.TCPAddr)
 	if !isTCP {
-		return fmt.Errorf("client is not connected using TCP")
+		return nil, fmt.Errorf("client is not connected using TCP")
+	}
+	if backend.IPv6SourcePrefix != nil {
+		clientIPv4 := clientTCPAddress.IP.To4()
+		if clientIPv4 == nil {
+			return nil, fmt.Errorf("client is not connected using IPv4")
+		}
+		sourceIPv6 := nat46SourceAddress(backend.IPv6SourcePrefix, clientIPv4)
+		return &syscall.SockaddrInet6{Addr: *(*[16]byte)(sourceIPv6)}, nil
+	} else {
+		if clientTCPAddress.IP.To4() != nil {
+			return nil, fmt.Errorf("client is not connected using IPv6")
+		}
+		sourceIPv4 := nat64SourceAddress(backend.IPv4SourcePrefix, clientTCPAddress.IP)
+		return &syscall.SockaddrInet4{Addr: *(*[4]byte)(sourceIPv4)}, nil
 	}
-	clientIPv4 := clientTCPAddress.IP.To4()
-	if clientIPv4 == nil {
-		return fmt.Errorf("client is not connected using IPv4")
+}
+
+func (backend *TCPDialer) bindSource(sock syscall.RawConn, clientConn ClientConn) error {
+	source, err := backend.sourceAddress(clientConn)
+	if err != nil {
+		return err
 	}
-	sourceIPv6 := make(net.IP, 16)
-	copy(sourceIPv6[:12], backend.IPv6SourcePrefix)
-	copy(sourceIPv6[12:], clientIPv4)
 
 	var controlErr error
 	if err := sock.Control(func(fd uintptr) {
@@ -79,7 +236,27 @@ func (backend *TCPDialer) bindIPv6(sock syscall.RawConn, clientConn ClientConn)
 		if controlErr != nil {
 			return
 		}
-		controlErr = syscall.Bind(int(fd), &syscall.SockaddrInet6{Addr: *(*[16]byte)(sourceIPv6)})
+		controlErr = syscall.Bind(int(fd), source)
+	}); err != nil {
+		return err
+	}
+	return controlErr
+}
+
+func setMark(sock syscall.RawConn, mark int) error {
+	var controlErr error
+	if err := sock.Control(func(fd uintptr) {
+		controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	}); err != nil {
+		return err
+	}
+	return controlErr
+}
+
+func setUserTimeout(sock syscall.RawConn, timeout time.Duration) error {
+	var controlErr error
+	if err := sock.Control(func(fd uintptr) {
+		controlErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(timeout.Milliseconds()))
 	}); err != nil {
 		return err
 	}
@@ -87,6 +264,9 @@ func (backend *TCPDialer) bindIPv6(sock syscall.RawConn, clientConn ClientConn)
 }
 
 func (backend *TCPDialer) port(clientConn ClientConn) (int, error) {
+	if overrider, ok := clientConn.(BackendPortOverrider); ok && overrider.BackendPort() != 0 {
+		return overrider.BackendPort(), nil
+	}
 	if backend.Port != 0 {
 		return backend.Port, nil
 	}
@@ -101,42 +281,343 @@ func (backend *TCPDialer) port(clientConn ClientConn) (int, error) {
 func (backend *TCPDialer) network() string {
 	if backend.IPv6SourcePrefix != nil {
 		return "tcp6"
+	} else if backend.IPv4SourcePrefix != nil {
+		return "tcp4"
 	} else {
 		return "tcp"
 	}
 }
 
 func (backend *TCPDialer) Dial(hostname string, protocols []string, clientConn ClientConn) (BackendConn, error) {
+	// attempts counts the allowed addresses which the dialer tried to
+	// connect to, so that it can be told when they were all down
+	var attempts atomic.Int32
 	dialer := net.Dialer{
-		Timeout: backend.Timeout,
+		Timeout:  backend.Timeout,
+		Resolver: backend.Resolver,
 		Control: func(network string, address string, c syscall.RawConn) error {
-			if err := backend.checkBackend(address); err != nil {
+			if err := backend.checkBackend(hostname, address); err != nil {
 				return err
 			}
-			if backend.IPv6SourcePrefix != nil {
-				if err := backend.bindIPv6(c, clientConn); err != nil {
+			if backend.PTRChecker != nil {
+				if err := backend.PTRChecker.Check(address); err != nil {
+					return err
+				}
+			}
+			if backend.IPv6SourcePrefix != nil || backend.IPv4SourcePrefix != nil {
+				if err := backend.bindSource(c, clientConn); err != nil {
 					return err
 				}
 			}
+			if backend.Mark != 0 {
+				if err := setMark(c, backend.Mark); err != nil {
+					return fmt.Errorf("setting SO_MARK: %w", err)
+				}
+			}
+			if backend.UserTimeout != 0 {
+				if err := setUserTimeout(c, backend.UserTimeout); err != nil {
+					return fmt.Errorf("setting TCP_USER_TIMEOUT: %w", err)
+				}
+			}
+			if backend.Observe {
+				return errObserved
+			}
+			attempts.Add(1)
 			return nil
 		},
 	}
 
-	if service := getSRVService(protocols); service != "" {
-		conn, err := dialSRV(dialer, backend.network(), hostname, service)
+	if len(backend.Spray) != 0 {
+		return backend.dialSpray(dialer, clientConn)
+	}
+	if route := backend.Routes.Lookup(hostname); route != nil {
+		return backend.dialRoute(dialer, route, clientConn)
+	}
+
+	service, proto := getSRVService(protocols), "tcp"
+	if service == "" {
+		service, proto = backend.SRVService, backend.SRVProto
+	}
+	if service != "" {
+		release, err := backend.acquireLookup(dialer.Timeout)
 		if err != nil {
 			return nil, err
 		}
-		return conn.(*net.TCPConn), nil
+		addrs, err := lookupSRV(backend.Resolver, hostname, service, proto)
+		release()
+		if err != nil {
+			return backend.dialCatchAll(dialer, err, clientConn)
+		}
+		conn, err := dialSRV(addrs, func(host string, port string) (BackendConn, error) {
+			ctx, cancel := timeoutContext(dialer.Timeout)
+			defer cancel()
+			ips, err := backend.lookupNetIP(ctx, dialer.Timeout, host)
+			if err != nil {
+				return nil, err
+			}
+			return backend.dialAddresses(ctx, dialer, ips, port)
+		})
+		if err != nil {
+			return backend.dialCatchAll(dialer, err, clientConn)
+		}
+		return conn, nil
 	}
 
 	port, err := backend.port(clientConn)
 	if err != nil {
 		return nil, err
 	}
-	conn, err := dialer.Dial(backend.network(), net.JoinHostPort(hostname, strconv.Itoa(port)))
+	conn, err := backend.dialHostname(dialer, hostname, port, clientConn, &attempts)
+	if err != nil {
+		return backend.dialCatchAll(dialer, err, clientConn)
+	}
+	return conn, nil
+}
+
+// dialCatchAll dials the CatchAll backend if err means that the hostname
+// doesn't exist in the DNS, and otherwise returns err
+func (backend *TCPDialer) dialCatchAll(dialer net.Dialer, err error, clientConn ClientConn) (BackendConn, error) {
+	var dnsErr *net.DNSError
+	if backend.CatchAll == "" || !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		return nil, err
+	}
+	return backend.dialRoute(dialer, &Route{Backend: backend.CatchAll}, clientConn)
+}
+
+func (backend *TCPDialer) ipNetwork() string {
+	return strings.Replace(backend.network(), "tcp", "ip", 1)
+}
+
+// dialHostname dials hostname, retrying once after AllDownRetry if all of
+// its addresses are down
+func (backend *TCPDialer) dialHostname(dialer net.Dialer, hostname string, port int, clientConn ClientConn, attempts *atomic.Int32) (BackendConn, error) {
+	conn, err := backend.dialHostnameOnce(dialer, hostname, port, clientConn, attempts)
+	if errors.Is(err, errAllBackendsDown) && backend.AllDownRetry != 0 {
+		time.Sleep(backend.AllDownRetry)
+		conn, err = backend.dialHostnameOnce(dialer, hostname, port, nil, attempts)
+	}
+	return conn, err
+}
+
+// dialHostnameOnce resolves hostname and dials its addresses.  If clientConn came from a listener, the
+// number of allowed addresses is observed in its metrics.  If any allowed
+// address was tried and every one tried failed to connect, the error
+// wraps errAllBackendsDown.
+func (backend *TCPDialer) dialHostnameOnce(dialer net.Dialer, hostname string, port int, clientConn ClientConn, attempts *atomic.Int32) (BackendConn, error) {
+	ctx, cancel := timeoutContext(dialer.Timeout)
+	defer cancel()
+	ips, err := backend.lookupNetIP(ctx, dialer.Timeout, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if conn, ok := clientConn.(*dialClientConn); ok {
+		backend.observeResolvedAddresses(hostname, ips, port, conn.listener)
+	}
+	attempts.Store(0)
+	conn, err := backend.dialAddresses(ctx, dialer, ips, strconv.Itoa(port))
+	if err != nil && !errors.Is(err, errObserved) && attempts.Load() > 0 {
+		return nil, fmt.Errorf("%w: %w", errAllBackendsDown, err)
+	}
+	return conn, err
+}
+
+// observeResolvedAddresses observes how many of ips, which hostname
+// resolved to, are allowed
+func (backend *TCPDialer) observeResolvedAddresses(hostname string, ips []netip.Addr, port int, listener listenerLabels) {
+	allowed := 0
+	for _, ip := range ips {
+		if backend.checkBackend(hostname, net.JoinHostPort(ip.Unmap().String(), strconv.Itoa(port))) == nil {
+			allowed++
+		}
+	}
+	listener.metrics.resolvedAddresses.Observe(float64(allowed))
+}
+
+// lookupNetIP resolves hostname, holding a lookup slot while it does
+func (backend *TCPDialer) lookupNetIP(ctx context.Context, timeout time.Duration, hostname string) ([]netip.Addr, error) {
+	release, err := backend.acquireLookup(timeout)
 	if err != nil {
 		return nil, err
 	}
-	return conn.(*net.TCPConn), nil
+	defer release()
+	return backend.Resolver.LookupNetIP(ctx, backend.ipNetwork(), hostname)
+}
+
+// timeoutContext returns a context which is done after timeout, or only
+// when canceled if timeout is zero
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// dialAddresses dials port on the first of ips to accept a connection,
+// the same way that net.Dialer dials the addresses of a hostname: the
+// addresses of the first one's family are tried in turn, each with its
+// share of the time left before ctx's deadline, and after FallbackDelay
+// (unless negative) the addresses of the other family are raced against
+// them (Happy Eyeballs, RFC 6555).
+func (backend *TCPDialer) dialAddresses(ctx context.Context, dialer net.Dialer, ips []netip.Addr, port string) (BackendConn, error) {
+	var primaries, fallbacks []netip.Addr
+	for _, ip := range ips {
+		if backend.network() != "tcp" || dialer.FallbackDelay < 0 || ip.Unmap().Is4() == ips[0].Unmap().Is4() {
+			primaries = append(primaries, ip)
+		} else {
+			fallbacks = append(fallbacks, ip)
+		}
+	}
+	if len(fallbacks) == 0 {
+		return backend.dialSerial(ctx, dialer, primaries, port)
+	}
+
+	type dialResult struct {
+		conn    BackendConn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+	race := func(ctx context.Context, ips []netip.Addr, primary bool) {
+		conn, err := backend.dialSerial(ctx, dialer, ips, port)
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	primaryCtx, primaryCancel := context.WithCancel(ctx)
+	defer primaryCancel()
+	go race(primaryCtx, primaries, true)
+
+	fallbackDelay := dialer.FallbackDelay
+	if fallbackDelay == 0 {
+		fallbackDelay = 300 * time.Millisecond
+	}
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr error
+	var primaryDone, fallbackDone bool
+	for {
+		select {
+		case <-fallbackTimer.C:
+			fallbackCtx, fallbackCancel := context.WithCancel(ctx)
+			defer fallbackCancel()
+			go race(fallbackCtx, fallbacks, false)
+		case result := <-results:
+			if result.err == nil || errors.Is(result.err, errObserved) {
+				return result.conn, result.err
+			}
+			if result.primary {
+				primaryErr, primaryDone = result.err, true
+				// Don't wait any longer to try the fallbacks
+				if fallbackTimer.Stop() {
+					fallbackTimer.Reset(0)
+				}
+			} else {
+				fallbackDone = true
+			}
+			if primaryDone && fallbackDone {
+				return nil, primaryErr
+			}
+		}
+	}
+}
+
+// dialSerial dials port on each of ips in turn until one accepts a
+// connection, giving each its share of the time left before ctx's
+// deadline (but at least 2 seconds, if there's that much left), and
+// returns the first error if none do
+func (backend *TCPDialer) dialSerial(ctx context.Context, dialer net.Dialer, ips []netip.Addr, port string) (BackendConn, error) {
+	var firstErr error
+	for i, ip := range ips {
+		if err := ctx.Err(); err != nil {
+			if firstErr == nil {
+				firstErr = &net.OpError{Op: "dial", Net: backend.network(), Err: err}
+			}
+			break
+		}
+		dialCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout := time.Until(deadline) / time.Duration(len(ips)-i)
+			if timeout < 2*time.Second {
+				timeout = min(2*time.Second, time.Until(deadline))
+			}
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		conn, err := backend.dialContext(dialCtx, dialer, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		} else if errors.Is(err, errObserved) {
+			return nil, err
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.OpError{Op: "dial", Net: backend.network(), Err: &net.AddrError{Err: "no suitable address found"}}
+	}
+	return nil, firstErr
+}
+
+func (backend *TCPDialer) dialRoute(dialer net.Dialer, route *Route, clientConn ClientConn) (BackendConn, error) {
+	if route.DialTimeout != 0 {
+		dialer.Timeout = route.DialTimeout
+	}
+	address := route.Backend
+	if conn, ok := clientConn.(*dialClientConn); ok {
+		address = route.backendForTLSVersion(conn.tlsVersion)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		port, err := backend.port(clientConn)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(address, strconv.Itoa(port))
+	}
+	return backend.dialContext(context.Background(), dialer, address)
+}
+
+// acquireLookup waits until fewer than MaxLookups DNS lookups are in
+// flight, for up to timeout (if non-zero), and then counts a new one,
+// which the returned function must be called to release.  Slots are
+// held only while resolving, and released before connecting, so that slow
+// backends can't starve lookups for other hostnames.
+func (backend *TCPDialer) acquireLookup(timeout time.Duration) (func(), error) {
+	if backend.MaxLookups != 0 {
+		backend.lookupSlotsOnce.Do(func() { backend.lookupSlots = make(chan struct{}, backend.MaxLookups) })
+		var expired <-chan time.Time
+		if timeout != 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case backend.lookupSlots <- struct{}{}:
+		case <-expired:
+			if backend.Metrics != nil {
+				backend.Metrics.lookupsShed.Inc()
+			}
+			return nil, errLookupLimit
+		}
+	}
+	if backend.Metrics != nil {
+		backend.Metrics.lookupsInFlight.Inc()
+	}
+	return func() {
+		if backend.Metrics != nil {
+			backend.Metrics.lookupsInFlight.Dec()
+		}
+		if backend.MaxLookups != 0 {
+			<-backend.lookupSlots
+		}
+	}, nil
 }
@@ -0,0 +1,440 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCheckBackendZone(t *testing.T) {
+	backend := &TCPDialer{
+		Port:    443,
+		Allowed: NewCIDRSet(mustParseCIDRs(t, "fe80::/10")),
+	}
+	tests := []struct {
+		address string
+		allowed bool
+	}{
+		{"[fe80::1%eth0]:443", true},
+		{"[fe80::1%25]:443", true},
+		{"[fe80::1]:443", true},
+		{"[febf:ffff::1%eth0]:443", true},
+		{"[fec0::1%eth0]:443", false},
+		{"[2001:db8::1%eth0]:443", false},
+	}
+	for _, test := range tests {
+		err := backend.checkBackend("example.com", test.address)
+		if test.allowed && err != nil {
+			t.Errorf("checkBackend(%s): unexpected error: %s", test.address, err)
+		} else if !test.allowed && !errors.Is(err, errDisallowedBackend) {
+			t.Errorf("checkBackend(%s): got %v, want errDisallowedBackend", test.address, err)
+		}
+	}
+
+	if err := backend.checkBackend("example.com", "[fe80::zz%eth0]:443"); err == nil || errors.Is(err, errDisallowedBackend) {
+		t.Errorf("checkBackend of an invalid address: got %v, want a parse error", err)
+	}
+	for _, address := range []string{"fe80::1%eth0", "[fe80::1%eth0]:8443"} {
+		if err := backend.checkRouteBackend("example.com", address); err != nil {
+			t.Errorf("checkRouteBackend(%s): unexpected error: %s", address, err)
+		}
+	}
+	if err := backend.checkRouteBackend("example.com", "2001:db8::1%eth0"); !errors.Is(err, errDisallowedBackend) {
+		t.Errorf("checkRouteBackend(2001:db8::1%%eth0): got %v, want errDisallowedBackend", err)
+	}
+}
+
+// linkLocalAddress returns a link-local IPv6 address of one of this
+// host's interfaces, with its zone
+func linkLocalAddress(t *testing.T) *net.IPAddr {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast() {
+				return &net.IPAddr{IP: ipnet.IP, Zone: iface.Name}
+			}
+		}
+	}
+	t.Skip("no interface has a link-local IPv6 address")
+	return nil
+}
+
+func TestDialZonedRoute(t *testing.T) {
+	addr := linkLocalAddress(t)
+	listener, err := net.ListenTCP("tcp6", &net.TCPAddr{IP: addr.IP, Zone: addr.Zone})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	routes := NewRouteTable()
+	route, err := parseRoute([]string{addr.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes.Set("example.com", route)
+	backend := &TCPDialer{
+		Port:    port,
+		Allowed: NewCIDRSet(mustParseCIDRs(t, "fe80::/10")),
+		Timeout: 5 * time.Second,
+		Routes:  routes,
+	}
+	if err := backend.checkRoute("example.com", route); err != nil {
+		t.Fatal(err)
+	}
+
+	clientConn := fakeClientConn{
+		localAddr:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+		remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234},
+	}
+	conn, err := backend.Dial("example.com", nil, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	if !remote.IP.Equal(addr.IP) || remote.Zone != addr.Zone || remote.Port != port {
+		t.Errorf("connected to %s, want %s", remote, net.JoinHostPort(addr.String(), strconv.Itoa(port)))
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
+
+// fakeDNSServer answers A and AAAA queries from records, and SRV queries
+// from srv, counting the queries for each name and calling onQuery (if
+// set) before answering
+type fakeDNSServer struct {
+	conn    net.PacketConn
+	records map[string][]netip.Addr
+	srv     map[string][]dnsmessage.SRVResource
+	onQuery func(question dnsmessage.Question)
+
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+// startFakeDNSServer starts serving DNS queries from server's records
+func startFakeDNSServer(t *testing.T, server *fakeDNSServer) *fakeDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	server.conn = conn
+	server.queries = make(map[string]int)
+	go server.serve()
+	return server
+}
+
+func (server *fakeDNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := server.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		if err != nil {
+			continue
+		}
+		question, err := parser.Question()
+		if err != nil {
+			continue
+		}
+		name := question.Name.String()
+		server.mu.Lock()
+		server.queries[name]++
+		server.mu.Unlock()
+		if server.onQuery != nil {
+			server.onQuery(question)
+		}
+
+		records, ok := server.records[name]
+		srv, isSRV := server.srv[name]
+		ok = ok || isSRV
+		response := dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true, RecursionDesired: header.RecursionDesired}
+		if !ok {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+		builder := dnsmessage.NewBuilder(nil, response)
+		builder.StartQuestions()
+		builder.Question(question)
+		builder.StartAnswers()
+		for _, ip := range records {
+			resource := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			if question.Type == dnsmessage.TypeA && ip.Is4() {
+				builder.AResource(resource, dnsmessage.AResource{A: ip.As4()})
+			} else if question.Type == dnsmessage.TypeAAAA && ip.Is6() {
+				builder.AAAAResource(resource, dnsmessage.AAAAResource{AAAA: ip.As16()})
+			}
+		}
+		if question.Type == dnsmessage.TypeSRV {
+			for _, record := range srv {
+				builder.SRVResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}, record)
+			}
+		}
+		message, err := builder.Finish()
+		if err != nil {
+			continue
+		}
+		server.conn.WriteTo(message, addr)
+	}
+}
+
+func (server *fakeDNSServer) queryCount(name string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.queries[name]
+}
+
+func TestDialHostnameLooksUpOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dns := startFakeDNSServer(t, &fakeDNSServer{records: map[string][]netip.Addr{
+		"backend.test.": {netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("192.0.2.1")},
+	}})
+	metrics := NewMetrics()
+	backend := &TCPDialer{
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		Allowed:  NewCIDRSet(mustParseCIDRs(t, "127.0.0.1/32")),
+		Timeout:  5 * time.Second,
+		Resolver: newResolver(dns.conn.LocalAddr().String()),
+		Metrics:  metrics,
+	}
+	labels := metrics.newListenerLabels(&net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443})
+	clientConn := &dialClientConn{
+		ClientConn: fakeClientConn{
+			localAddr:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+			remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234},
+		},
+		listener: labels,
+	}
+
+	conn, err := backend.Dial("backend.test.", nil, clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// One lookup is an A query and an AAAA query
+	if queries := dns.queryCount("backend.test."); queries != 2 {
+		t.Errorf("dialing made %d DNS queries, want 2", queries)
+	}
+	histogram := metricValue(t, labels.metrics.resolvedAddresses.(prometheus.Metric)).GetHistogram()
+	if histogram.GetSampleCount() != 1 || histogram.GetSampleSum() != 1 {
+		t.Errorf("observed %d resolved address counts summing to %g, want one of 1", histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+
+	if _, err := backend.Dial("missing.test.", nil, clientConn); errorLabelValue(&BackendError{Err: err}) != "backend-not-found" {
+		t.Errorf("dialing a missing hostname: got %v, want a not found error", err)
+	}
+	if queries := dns.queryCount("missing.test."); queries != 2 {
+		t.Errorf("dialing a missing hostname made %d DNS queries, want 2", queries)
+	}
+}
+
+// newDualStackListener listens on the same port of 127.0.0.1 and ::1,
+// skipping the test if IPv6 isn't available
+func newDualStackListener(t *testing.T) (port int) {
+	listener4, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener4.Close() })
+	port = listener4.Addr().(*net.TCPAddr).Port
+	listener6, err := net.Listen("tcp6", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { listener6.Close() })
+	for _, listener := range []net.Listener{listener4, listener6} {
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+	return port
+}
+
+func TestDialAddresses(t *testing.T) {
+	port := strconv.Itoa(newDualStackListener(t))
+	loopback4, loopback6 := netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")
+	// Nothing listens on 127.0.0.2, so connecting to it is refused
+	refused := netip.MustParseAddr("127.0.0.2")
+
+	tests := []struct {
+		name          string
+		ips           []netip.Addr
+		slow          netip.Addr // Control blocks when dialing this address
+		fallbackDelay time.Duration
+		want          netip.Addr
+	}{
+		{name: "first", ips: []netip.Addr{loopback4, loopback6}, want: loopback4},
+		{name: "serial", ips: []netip.Addr{refused, loopback4}, want: loopback4},
+		{name: "fallback after failure", ips: []netip.Addr{refused, loopback6}, want: loopback6},
+		{name: "fallback while slow", ips: []netip.Addr{loopback4, loopback6}, slow: loopback4, fallbackDelay: 50 * time.Millisecond, want: loopback6},
+		{name: "no fallback", ips: []netip.Addr{loopback6, loopback4}, slow: loopback6, fallbackDelay: -1, want: loopback6},
+	}
+	for _, test := range tests {
+		backend := &TCPDialer{}
+		dialer := net.Dialer{
+			FallbackDelay: test.fallbackDelay,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				if test.slow.IsValid() && address == net.JoinHostPort(test.slow.String(), port) {
+					time.Sleep(500 * time.Millisecond)
+				}
+				return nil
+			},
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
+		conn, err := backend.dialAddresses(ctx, dialer, test.ips, port)
+		cancel()
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		conn.Close()
+		if got := conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr(); got != test.want {
+			t.Errorf("%s: connected to %s, want %s", test.name, got, test.want)
+		}
+		if test.fallbackDelay > 0 && time.Since(start) >= 500*time.Millisecond {
+			t.Errorf("%s: took %s, so the fallback didn't race the slow address", test.name, time.Since(start))
+		}
+	}
+
+	backend := &TCPDialer{}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := backend.dialAddresses(ctx, net.Dialer{}, []netip.Addr{refused}, port); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("dialing only a refused address: got %v, want ECONNREFUSED", err)
+	}
+	if _, err := backend.dialAddresses(ctx, net.Dialer{}, nil, port); err == nil {
+		t.Error("dialing no addresses succeeded")
+	}
+}
+
+func TestLookupSlotReleasedBeforeConnecting(t *testing.T) {
+	metrics := NewMetrics()
+	// The PTR lookup is done by the dialer's Control function, while
+	// connecting, after the lookup of the backend's address.  (127.0.0.3
+	// is used since 127.0.0.1 is in /etc/hosts.)
+	var inFlight atomic.Int64
+	dns := startFakeDNSServer(t, &fakeDNSServer{
+		records: map[string][]netip.Addr{
+			"backend.test.": {netip.MustParseAddr("127.0.0.3")},
+			"target.test.":  {netip.MustParseAddr("127.0.0.3")},
+		},
+		srv: map[string][]dnsmessage.SRVResource{
+			"_xmpps-client._tcp.backend.test.": {{Target: dnsmessage.MustNewName("target.test."), Port: 443}},
+		},
+		onQuery: func(question dnsmessage.Question) {
+			if question.Type == dnsmessage.TypePTR {
+				inFlight.Store(int64(metricValue(t, metrics.lookupsInFlight).GetGauge().GetValue()))
+			}
+		},
+	})
+	resolver := newResolver(dns.conn.LocalAddr().String())
+	backend := &TCPDialer{
+		Port:       443,
+		Allowed:    NewCIDRSet(mustParseCIDRs(t, "127.0.0.3/32")),
+		Timeout:    5 * time.Second,
+		Resolver:   resolver,
+		Metrics:    metrics,
+		MaxLookups: 1,
+		PTRChecker: &PTRChecker{Suffixes: new(SuffixSet), Resolver: resolver},
+	}
+	clientConn := fakeClientConn{
+		localAddr:  &net.TCPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 443},
+		remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51234},
+	}
+
+	tests := []struct {
+		name      string
+		protocols []string
+	}{
+		{name: "hostname"},
+		{name: "SRV", protocols: []string{"xmpp-client"}},
+	}
+	for _, test := range tests {
+		inFlight.Store(-1)
+		backend.PTRChecker = &PTRChecker{Suffixes: new(SuffixSet), Resolver: resolver}
+		if _, err := backend.Dial("backend.test.", test.protocols, clientConn); !errors.Is(err, errPTRMismatch) {
+			t.Errorf("%s: got %v, want a PTR mismatch", test.name, err)
+		}
+		if got := inFlight.Load(); got != 0 {
+			t.Errorf("%s: %d lookups in flight while connecting, want 0", test.name, got)
+		}
+	}
+	if queries := dns.queryCount("target.test."); queries != 2 {
+		t.Errorf("dialing the SRV target made %d DNS queries, want 2", queries)
+	}
+}
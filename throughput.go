@@ -0,0 +1,119 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	throughputInterval = time.Second
+	throughputAlpha    = 0.2 // weight of the latest interval in the EWMA
+)
+
+type connThroughput struct {
+	lastTotal uint64
+	rate      float64 // bytes/second
+}
+
+// throughputTracker maintains an exponentially-weighted moving average of
+// the throughput of each active backend connection, and exports the sum
+// per backend.  Connections are forgotten as soon as they are untracked,
+// so memory use is bounded by the number of active connections.
+type throughputTracker struct {
+	mu    sync.Mutex
+	conns map[*instrumentedConn]*connThroughput
+	desc  *prometheus.Desc
+}
+
+func newThroughputTracker() *throughputTracker {
+	tracker := &throughputTracker{
+		conns: make(map[*instrumentedConn]*connThroughput),
+		desc: prometheus.NewDesc(
+			"snid_backend_throughput_bytes_per_second",
+			"Smoothed throughput (both directions) of active connections, by backend.",
+			[]string{"backend"}, nil,
+		),
+	}
+	go tracker.run()
+	return tracker
+}
+
+func (tracker *throughputTracker) Track(backend string, conn BackendConn) *instrumentedConn {
+	instrumented := &instrumentedConn{BackendConn: conn, backend: backend}
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	tracker.conns[instrumented] = new(connThroughput)
+	return instrumented
+}
+
+func (tracker *throughputTracker) Untrack(conn *instrumentedConn) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	delete(tracker.conns, conn)
+}
+
+func (tracker *throughputTracker) run() {
+	ticker := time.NewTicker(throughputInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		tracker.update()
+	}
+}
+
+func (tracker *throughputTracker) update() {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	for conn, throughput := range tracker.conns {
+		// The byte counts are 64-bit, so they can't wrap around in any
+		// realistic connection, but never let a decrease in the total
+		// turn into a huge rate
+		total := max(conn.totalBytes(), throughput.lastTotal)
+		rate := float64(total-throughput.lastTotal) / throughputInterval.Seconds()
+		throughput.rate = throughputAlpha*rate + (1-throughputAlpha)*throughput.rate
+		throughput.lastTotal = total
+	}
+}
+
+func (tracker *throughputTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tracker.desc
+}
+
+func (tracker *throughputTracker) Collect(ch chan<- prometheus.Metric) {
+	tracker.mu.Lock()
+	rates := make(map[string]float64)
+	for conn, throughput := range tracker.conns {
+		rates[conn.backend] += throughput.rate
+	}
+	tracker.mu.Unlock()
+
+	for backend, rate := range rates {
+		ch <- prometheus.MustNewConstMetric(tracker.desc, prometheus.GaugeValue, rate, backend)
+	}
+}
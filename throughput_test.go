@@ -0,0 +1,63 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestThroughputLargeCounters(t *testing.T) {
+	tracker := &throughputTracker{conns: make(map[*instrumentedConn]*connThroughput)}
+	conn := new(instrumentedConn)
+	throughput := &connThroughput{lastTotal: math.MaxUint64 - 3*terabyte}
+	tracker.conns[conn] = throughput
+
+	// 1 TB/s for three intervals approaches, but doesn't pass, the limit
+	conn.bytesRead.Store(math.MaxUint64 - 3*terabyte)
+	for range 3 {
+		conn.bytesRead.Add(terabyte)
+		tracker.update()
+	}
+	if throughput.lastTotal != math.MaxUint64 {
+		t.Fatalf("lastTotal = %d, want %d", throughput.lastTotal, uint64(math.MaxUint64))
+	}
+	wantRate := (1 - math.Pow(1-throughputAlpha, 3)) * terabyte
+	if math.Abs(throughput.rate-wantRate) > 1 {
+		t.Errorf("rate = %g, want %g", throughput.rate, wantRate)
+	}
+
+	// Further transfers saturate the total, rather than wrapping around
+	// to a small total and then being counted as a huge rate
+	conn.bytesWritten.Store(terabyte)
+	tracker.update()
+	if throughput.lastTotal != math.MaxUint64 {
+		t.Errorf("lastTotal = %d after overflow, want %d", throughput.lastTotal, uint64(math.MaxUint64))
+	}
+	if throughput.rate > wantRate {
+		t.Errorf("rate = %g after overflow, want at most %g", throughput.rate, wantRate)
+	}
+}
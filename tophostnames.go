@@ -0,0 +1,122 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+	"sync"
+)
+
+// TopHostnames tracks approximately the Size most frequently requested
+// hostnames in fixed memory, using the Space-Saving algorithm.  The
+// counts are kept in a min-heap, so that the least-counted hostname can
+// be replaced in logarithmic time.
+type TopHostnames struct {
+	Size int
+
+	mu     sync.Mutex
+	counts map[string]*hostnameCount
+	heap   hostnameHeap
+}
+
+type hostnameCount struct {
+	Hostname string
+	Count    uint64 // may overestimate the true count by up to Error
+	Error    uint64
+
+	index int // in TopHostnames.heap
+}
+
+// Observe counts a request for hostname
+func (top *TopHostnames) Observe(hostname string) {
+	if top == nil {
+		return
+	}
+	top.mu.Lock()
+	defer top.mu.Unlock()
+	if entry, ok := top.counts[hostname]; ok {
+		entry.Count++
+		heap.Fix(&top.heap, entry.index)
+		return
+	}
+	if top.counts == nil {
+		top.counts = make(map[string]*hostnameCount, top.Size)
+	}
+	if len(top.counts) < top.Size {
+		entry := &hostnameCount{Hostname: hostname, Count: 1}
+		top.counts[hostname] = entry
+		heap.Push(&top.heap, entry)
+		return
+	}
+	// Replace the least-counted hostname, inheriting its count as the
+	// new hostname's maximum error
+	min := top.heap[0]
+	delete(top.counts, min.Hostname)
+	min.Hostname, min.Error = hostname, min.Count
+	min.Count++
+	top.counts[hostname] = min
+	heap.Fix(&top.heap, 0)
+}
+
+// Snapshot returns the tracked hostnames, most frequent first
+func (top *TopHostnames) Snapshot() []hostnameCount {
+	top.mu.Lock()
+	entries := make([]hostnameCount, 0, len(top.counts))
+	for _, entry := range top.counts {
+		entries = append(entries, *entry)
+	}
+	top.mu.Unlock()
+	slices.SortFunc(entries, func(a, b hostnameCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Hostname, b.Hostname))
+	})
+	return entries
+}
+
+// hostnameHeap implements heap.Interface, ordering hostnames by count
+type hostnameHeap []*hostnameCount
+
+func (h hostnameHeap) Len() int           { return len(h) }
+func (h hostnameHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h hostnameHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hostnameHeap) Push(x any) {
+	entry := x.(*hostnameCount)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *hostnameHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
@@ -0,0 +1,60 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// connPhases records when each phase of a connection finished, so that
+// they can be logged for sampled connections.  Phases which didn't happen
+// are zero.
+type connPhases struct {
+	start     time.Time // connection accepted
+	peeked    time.Time // ClientHello received
+	dialed    time.Time // backend connected
+	firstByte time.Time // first byte received from backend
+	closed    time.Time // connection closed
+}
+
+func (server *Server) sampleTrace() bool {
+	return server.TraceSampleRate > 0 && rand.Float64() < server.TraceSampleRate
+}
+
+func (phases *connPhases) since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Sub(phases.start).String()
+}
+
+func (phases *connPhases) log(clientAddr net.Addr, serverName string) {
+	log.Printf("Trace of connection from %s to %q: peek %s, dial %s, first byte %s, close %s",
+		clientAddr, serverName, phases.since(phases.peeked), phases.since(phases.dialed), phases.since(phases.firstByte), phases.since(phases.closed))
+}
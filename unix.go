@@ -26,15 +26,31 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net"
+	"os"
 	"path/filepath"
 )
 
 type UnixDialer struct {
 	Directory string
+
+	// If true, sockets are in a subdirectory of Directory named after
+	// the first two hex digits of the SHA-256 hash of the socket name
+	Shard bool
+
+	// If non-empty, the name of the socket to use for hostnames which
+	// have no socket of their own
+	CatchAll string
+
+	// If true, stop short of connecting to the socket, and return an
+	// error wrapping errObserved (in a *net.OpError containing the
+	// socket path) if it exists
+	Observe bool
 }
 
 func (backend *UnixDialer) Dial(origHostname string, protocols []string, clientConn ClientConn) (BackendConn, error) {
@@ -55,10 +71,41 @@ func (backend *UnixDialer) Dial(origHostname string, protocols []string, clientC
 		return nil, err
 	}
 
-	return nil, fmt.Errorf("no backend socket found for %q", hostname)
+	if backend.CatchAll != "" {
+		if conn, err := backend.dial(backend.CatchAll); err == nil {
+			return conn, nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("%w for %q", errBackendNotFound, hostname)
+}
+
+func (backend *UnixDialer) socketPath(socketName string) (string, error) {
+	directory := backend.Directory
+	if backend.Shard {
+		hash := sha256.Sum256([]byte(socketName))
+		directory = filepath.Join(directory, hex.EncodeToString(hash[:1]))
+	}
+	socketPath := filepath.Join(directory, socketName)
+	if filepath.Dir(socketPath) != filepath.Clean(directory) {
+		return "", fmt.Errorf("socket path for %q is outside %s", socketName, directory)
+	}
+	return socketPath, nil
 }
 
 func (backend *UnixDialer) dial(socketName string) (BackendConn, error) {
-	socketPath := filepath.Join(backend.Directory, socketName)
-	return net.DialUnix("unix", nil, &net.UnixAddr{Net: "unix", Name: socketPath})
+	socketPath, err := backend.socketPath(socketName)
+	if err != nil {
+		return nil, err
+	}
+	addr := &net.UnixAddr{Net: "unix", Name: socketPath}
+	if backend.Observe {
+		if _, err := os.Stat(socketPath); err != nil {
+			return nil, err
+		}
+		return nil, &net.OpError{Op: "dial", Net: "unix", Addr: addr, Err: errObserved}
+	}
+	return net.DialUnix("unix", nil, addr)
 }
@@ -0,0 +1,120 @@
+// Copyright (C) 2022 Andrew Ayer
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+// Except as contained in this notice, the name(s) of the above copyright
+// holders shall not be used in advertising or otherwise to promote the
+// sale, use or other dealings in this Software without prior written
+// authorization.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	EventAccepted = "accepted" // connection forwarded to backend
+	EventDenied   = "denied"   // dialing the backend failed
+	EventNoSNI    = "no-sni"   // client did not provide SNI
+)
+
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	ClientAddr string    `json:"client_addr"`
+	ServerName string    `json:"server_name,omitempty"`
+	Accepted   bool      `json:"accepted"`
+
+	// The backend address that snid connected to (or tried to), and how
+	// long dialing took, if the backend was dialed
+	BackendAddr string  `json:"backend_addr,omitempty"`
+	DialSeconds float64 `json:"dial_seconds,omitempty"`
+}
+
+// Webhook delivers events to a URL as JSON POST requests.  Delivery is
+// asynchronous and best-effort: events are dropped (and counted) when the
+// buffer is full or the request fails.
+type Webhook struct {
+	url     string
+	types   map[string]bool
+	events  chan *Event
+	client  http.Client
+	metrics *Metrics
+}
+
+const webhookBufferSize = 1024
+
+func NewWebhook(url string, types []string, metrics *Metrics) *Webhook {
+	webhook := &Webhook{
+		url:     url,
+		types:   make(map[string]bool),
+		events:  make(chan *Event, webhookBufferSize),
+		client:  http.Client{Timeout: 10 * time.Second},
+		metrics: metrics,
+	}
+	for _, eventType := range types {
+		webhook.types[eventType] = true
+	}
+	go webhook.run()
+	return webhook
+}
+
+// Send queues an event for delivery without blocking.  It does nothing if
+// webhook is nil or the event's type is not enabled.
+func (webhook *Webhook) Send(event *Event) {
+	if webhook == nil || !webhook.types[event.Type] {
+		return
+	}
+	select {
+	case webhook.events <- event:
+	default:
+		webhook.metrics.webhookDrops.WithLabelValues("buffer-full").Inc()
+	}
+}
+
+func (webhook *Webhook) run() {
+	for event := range webhook.events {
+		if err := webhook.deliver(event); err != nil {
+			webhook.metrics.webhookDrops.WithLabelValues("delivery-failed").Inc()
+		}
+	}
+}
+
+func (webhook *Webhook) deliver(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := webhook.client.Post(webhook.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}